@@ -1,14 +1,83 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"time"
 
 	"go-torrent/utils"
 )
 
+func scrape(torrent utils.TorrentFile) {
+	trackers := utils.NewTrackers(torrent.AnnounceList)
+
+	for _, tier := range trackers.Tiers {
+		for _, tracker := range tier {
+			results, err := tracker.Scrape([][20]byte{torrent.InfoHash})
+			if err != nil {
+				fmt.Printf("%s: %s\n", tracker.AnnounceURL, err)
+				continue
+			}
+
+			result := results[torrent.InfoHash]
+			fmt.Printf("%s: %d seeders, %d leechers, %d completed\n", tracker.AnnounceURL, result.Seeders, result.Leechers, result.Completed)
+		}
+	}
+}
+
+func serveTracker() {
+	server := utils.NewTrackerServer()
+
+	if len(utils.GetWhitelist()) > 0 {
+		err := server.LoadWhitelist(utils.GetWhitelist())
+		if err != nil {
+			log.Fatal("Error loading whitelist: ", err)
+		}
+	}
+
+	err := server.ListenAndServe(utils.GetTrackerAddr())
+	if err != nil {
+		log.Fatal("Error starting tracker: ", err)
+	}
+	defer server.Close()
+
+	fmt.Printf("Tracker listening on %s\n", utils.GetTrackerAddr())
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
+
+// openStorage stores in-progress data in the incomplete directory, if one is
+// set, and in the save path otherwise, behind a cache. Data already in the save
+// path is used where it is.
+func openStorage(torrent utils.TorrentFile) (utils.Storage, error) {
+	root, suffix := utils.GetSavePath(), ""
+	if len(utils.GetIncompleteDir()) > 0 && !utils.HasStoredData(torrent, root) {
+		root, suffix = utils.GetIncompleteDir(), ".part"
+	}
+
+	storage, err := utils.NewStorage(utils.GetStorage(), torrent, root, suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	if utils.GetWriteCache() == 0 && utils.GetReadCache() == 0 {
+		return storage, nil
+	}
+
+	return utils.NewCachedStorage(storage, torrent, utils.GetWriteCache(), utils.GetReadCache()), nil
+}
+
 func main() {
+	if utils.GetCommand() == "tracker" {
+		serveTracker()
+		return
+	}
+
 	file, err := os.Open(utils.GetFilePath())
 	if err != nil {
 		log.Fatal("Error opening file: ", err)
@@ -20,17 +89,81 @@ func main() {
 		log.Fatal("Error decoding file: ", err)
 	}
 
-	download, err := utils.StartDownload(torrent)
+	switch utils.GetCommand() {
+	case "":
+	case "scrape":
+		scrape(torrent)
+		return
+	default:
+		log.Fatal("Unknown command: ", utils.GetCommand())
+	}
+
+	storage, err := openStorage(torrent)
+	if err != nil {
+		log.Fatal("Error opening storage: ", err)
+	}
+
+	download, err := utils.StartDownload(torrent, storage, utils.DownloadOptions{
+		SavePath:    utils.GetSavePath(),
+		Preallocate: utils.GetPreallocate(),
+	})
 	if err != nil {
 		log.Fatal("Error initiating download: ", err)
 	}
 	defer download.Close()
 
+	if utils.GetSuperSeed() {
+		download.StartSuperSeeding()
+	}
+
+	filter, err := utils.NewIPFilter(utils.GetBlocklists())
+	if err != nil {
+		log.Fatal("Error loading blocklist: ", err)
+	}
+	filter.WatchReload()
+	download.Filter = filter
+	download.UseUTP = utils.GetUTP()
+
+	listener, err := download.Listen(utils.GetPort())
+	if err != nil {
+		log.Fatal("Error listening for peers: ", err)
+	}
+	defer listener.Close()
+
+	err = download.StartChoker(utils.GetUploadSlots(), utils.GetOptimisticSlots(), utils.GetSeedChoker())
+	if err != nil {
+		log.Fatal("Error starting choker: ", err)
+	}
+
+	if utils.GetLSD() && !torrent.Private {
+		port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+		discovery, err := utils.StartLocalDiscovery(download, port, utils.GetLSDInterface(), utils.LSDGroups)
+		if err != nil {
+			log.Fatal("Error starting local peer discovery: ", err)
+		}
+		defer discovery.Stop()
+	}
+
+	for _, seed := range utils.NewWebSeeds(torrent) {
+		go download.AddWebSeed(seed)
+	}
+
 	trackers := utils.NewTrackers(torrent.AnnounceList)
-	trackers.Announce(torrent, download)
+	trackers.Start(torrent, download)
+	defer trackers.Stop()
 
 	display := utils.StartDisplay(download, time.Millisecond*100)
 	defer display.Close()
 
-	<-download.Completed
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	select {
+	case <-download.Completed:
+		if utils.GetSeed() || utils.GetSuperSeed() {
+			<-interrupt
+		}
+	case <-interrupt:
+	}
 }
@@ -0,0 +1,16 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func allocate(file *os.File, size int64, length int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return fillZeros(file, size, length)
+	}
+
+	return err
+}
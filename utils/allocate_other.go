@@ -0,0 +1,11 @@
+//go:build !linux
+
+package utils
+
+import (
+	"os"
+)
+
+func allocate(file *os.File, size int64, length int64) error {
+	return fillZeros(file, size, length)
+}
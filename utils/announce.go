@@ -5,9 +5,24 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
+	"math/rand"
 	"net/url"
+	"time"
 )
 
+const (
+	EventNone      uint32 = 0
+	EventCompleted uint32 = 1
+	EventStarted   uint32 = 2
+	EventStopped   uint32 = 3
+)
+
+var eventNames = map[uint32]string{
+	EventCompleted: "completed",
+	EventStarted:   "started",
+	EventStopped:   "stopped",
+}
+
 type AnnounceMessage struct {
 	ConnectionID  uint64
 	Action        uint32
@@ -24,14 +39,18 @@ type AnnounceMessage struct {
 	Port          uint16
 }
 
-func GenerateAnnounceMessage(torrent TorrentFile) AnnounceMessage {
+// sessionKey identifies this client to trackers across IP address changes.
+var sessionKey = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+
+func GenerateAnnounceMessage(torrent TorrentFile, port uint16) AnnounceMessage {
 	return AnnounceMessage{
 		Action:   1,
 		InfoHash: torrent.InfoHash,
 		PeerID:   sha1.Sum([]byte("-TR2940-k8hj0wgej6ch")),
 		Left:     uint64(torrent.Length),
-		NumWant:  ^uint32(0),
-		Port:     1337,
+		Key:      sessionKey,
+		NumWant:  50,
+		Port:     port,
 	}
 }
 
@@ -50,6 +69,21 @@ func (m AnnounceMessage) ToQueryParams() string {
 	q.Add("uploaded", fmt.Sprint(m.Uploaded))
 	q.Add("downloaded", fmt.Sprint(m.Downloaded))
 	q.Add("left", fmt.Sprint(m.Left))
+	q.Add("compact", "1")
+	q.Add("numwant", fmt.Sprint(m.NumWant))
+	q.Add("key", fmt.Sprintf("%08x", m.Key))
+
+	if event, ok := eventNames[m.Event]; ok {
+		q.Add("event", event)
+	}
 
 	return q.Encode()
 }
+
+type AnnounceResponse struct {
+	Peers       []Peer
+	Interval    time.Duration
+	MinInterval time.Duration
+	Seeders     int
+	Leechers    int
+}
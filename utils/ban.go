@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+const maxStrikes = 3
+
+type BanList struct {
+	lock    sync.Mutex
+	strikes map[string]int
+	banned  map[string]bool
+	failed  map[int]map[string]bool
+}
+
+func NewBanList() *BanList {
+	return &BanList{
+		strikes: make(map[string]int),
+		banned:  make(map[string]bool),
+		failed:  make(map[int]map[string]bool),
+	}
+}
+
+func (bans *BanList) IsBanned(ip net.IP) bool {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	return bans.banned[ip.String()]
+}
+
+// RecordFailure gives a strike to every peer that contributed blocks to a piece
+// that failed its hash check, and returns the peers that were banned as a result.
+func (bans *BanList) RecordFailure(index int, contributors []net.IP) []string {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	if bans.failed[index] == nil {
+		bans.failed[index] = make(map[string]bool)
+	}
+
+	newlyBanned := make([]string, 0)
+	for _, ip := range contributors {
+		key := ip.String()
+		bans.failed[index][key] = true
+
+		if bans.strike(key) {
+			newlyBanned = append(newlyBanned, key)
+		}
+	}
+
+	return newlyBanned
+}
+
+// RecordSuccess is called once a piece passes its hash check. Any peer that
+// contributed to an earlier failed attempt at the piece, but not to the passing
+// one, is now known to have sent bad data and gets another strike.
+func (bans *BanList) RecordSuccess(index int, contributors []net.IP) []string {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	failed, ok := bans.failed[index]
+	if !ok {
+		return nil
+	}
+	delete(bans.failed, index)
+
+	for _, ip := range contributors {
+		delete(failed, ip.String())
+	}
+
+	newlyBanned := make([]string, 0)
+	for key := range failed {
+		if bans.strike(key) {
+			newlyBanned = append(newlyBanned, key)
+		}
+	}
+
+	return newlyBanned
+}
+
+// strike records a strike against a peer, and reports whether that got it
+// banned.
+func (bans *BanList) strike(key string) bool {
+	bans.strikes[key] += 1
+
+	if bans.strikes[key] < maxStrikes || bans.banned[key] {
+		return false
+	}
+
+	bans.banned[key] = true
+	return true
+}
+
+func (bans *BanList) Banned() []string {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	banned := make([]string, 0, len(bans.banned))
+	for key := range bans.banned {
+		banned = append(banned, key)
+	}
+	sort.Strings(banned)
+
+	return banned
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBanListOneBadPiece(t *testing.T) {
+	bans := NewBanList()
+	bad, good := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+
+	// One corrupt piece, then the same piece from someone else, isn't enough
+	// to ban.
+	if banned := bans.RecordFailure(0, []net.IP{bad}); len(banned) != 0 {
+		t.Errorf("banned %v after one failure", banned)
+	}
+	if banned := bans.RecordSuccess(0, []net.IP{good}); len(banned) != 0 {
+		t.Errorf("banned %v after one bad piece", banned)
+	}
+	if bans.IsBanned(bad) || bans.IsBanned(good) {
+		t.Error("banned a peer for one bad piece")
+	}
+}
+
+func TestBanListRepeatOffender(t *testing.T) {
+	bans := NewBanList()
+	bad, good := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+
+	bans.RecordFailure(0, []net.IP{bad})
+	bans.RecordSuccess(0, []net.IP{good})
+
+	banned := bans.RecordFailure(1, []net.IP{bad})
+	if len(banned) != 1 || banned[0] != bad.String() || !bans.IsBanned(bad) {
+		t.Errorf("banned %v after a second bad piece, want %s", banned, bad)
+	}
+
+	// A ban is only reported once.
+	if banned := bans.RecordFailure(2, []net.IP{bad}); len(banned) != 0 {
+		t.Errorf("reported %v as banned again", banned)
+	}
+	if bans.IsBanned(good) {
+		t.Error("banned the peer that sent the good piece")
+	}
+}
+
+func TestBanListRetryBySamePeer(t *testing.T) {
+	bans := NewBanList()
+	peer := net.IPv4(192, 0, 2, 1)
+
+	// A peer that fails a piece and then sends it correctly only gets the
+	// strike for the failure.
+	bans.RecordFailure(0, []net.IP{peer})
+	bans.RecordSuccess(0, []net.IP{peer})
+	bans.RecordFailure(1, []net.IP{peer})
+
+	if bans.IsBanned(peer) {
+		t.Error("banned a peer with two strikes")
+	}
+}
@@ -1,5 +1,7 @@
 package utils
 
+import "math/bits"
+
 type Bitfield []byte
 
 func CreateBitfield(length int) Bitfield {
@@ -20,6 +22,15 @@ func (b Bitfield) HasPiece(index int) bool {
 func (b *Bitfield) SetPiece(index int) {
 	bitOffset := index % 8
 
-	andable := byte(2 ^ (7 - bitOffset))
-	(*b)[index/8] &= andable
+	(*b)[index/8] |= 1 << (7 - bitOffset)
+}
+
+// Count returns the number of pieces set.
+func (b Bitfield) Count() int {
+	count := 0
+	for _, targetByte := range b {
+		count += bits.OnesCount8(targetByte)
+	}
+
+	return count
 }
@@ -0,0 +1,319 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type ipRange struct {
+	Start netip.Addr
+	End   netip.Addr
+}
+
+type IPFilter struct {
+	lock    sync.RWMutex
+	sources []string
+	ranges  []ipRange
+}
+
+func NewIPFilter(sources []string) (*IPFilter, error) {
+	filter := &IPFilter{sources: sources}
+
+	err := filter.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// Reload re-reads every blocklist source. The previous ranges stay in place
+// if any source fails to load.
+func (filter *IPFilter) Reload() error {
+	ranges := make([]ipRange, 0)
+
+	for _, source := range filter.sources {
+		sourceRanges, err := loadBlocklist(source)
+		if err != nil {
+			return fmt.Errorf("loading blocklist %s: %w", source, err)
+		}
+
+		ranges = append(ranges, sourceRanges...)
+	}
+
+	ranges = mergeRanges(ranges)
+
+	filter.lock.Lock()
+	filter.ranges = ranges
+	filter.lock.Unlock()
+
+	Debugf("Loaded %d blocked IP ranges", len(ranges))
+
+	return nil
+}
+
+// WatchReload reloads the blocklists whenever the process receives SIGHUP.
+func (filter *IPFilter) WatchReload() {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+
+	go func() {
+		for range signalChan {
+			if err := filter.Reload(); err != nil {
+				Debugf("Error reloading blocklist: %s", err)
+			}
+		}
+	}()
+}
+
+func (filter *IPFilter) Blocked(ip net.IP) bool {
+	if filter == nil {
+		return false
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	filter.lock.RLock()
+	defer filter.lock.RUnlock()
+
+	// Find the last range starting at or before the address.
+	index := sort.Search(len(filter.ranges), func(i int) bool {
+		return filter.ranges[i].Start.Compare(addr) > 0
+	}) - 1
+
+	return index >= 0 && filter.ranges[index].End.Compare(addr) >= 0
+}
+
+func (filter *IPFilter) Len() int {
+	if filter == nil {
+		return 0
+	}
+
+	filter.lock.RLock()
+	defer filter.lock.RUnlock()
+
+	return len(filter.ranges)
+}
+
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start.Less(ranges[j].Start)
+	})
+
+	merged := make([]ipRange, 0, len(ranges))
+	for _, r := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && merged[last].Start.Is4() == r.Start.Is4() {
+			next := merged[last].End.Next()
+			if r.Start.Compare(merged[last].End) <= 0 || (next.IsValid() && next == r.Start) {
+				if r.End.Compare(merged[last].End) > 0 {
+					merged[last].End = r.End
+				}
+				continue
+			}
+		}
+
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+func loadBlocklist(source string) ([]ipRange, error) {
+	var reader io.ReadCloser
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := http.Client{Timeout: 30 * time.Second}
+		httpResp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+
+		if httpResp.StatusCode != http.StatusOK {
+			httpResp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s", httpResp.Status)
+		}
+
+		reader = httpResp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+
+		reader = file
+	}
+	defer reader.Close()
+
+	buffered := bufio.NewReader(reader)
+
+	// Published blocklists are commonly distributed gzipped.
+	magic, _ := buffered.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+
+		return ParseBlocklist(gzipReader)
+	}
+
+	return ParseBlocklist(buffered)
+}
+
+// ParseBlocklist reads ranges in either the P2P text format
+// ("description:start-end") or the eMule DAT format
+// ("start - end , level , description"). Malformed lines are skipped.
+func ParseBlocklist(r io.Reader) ([]ipRange, error) {
+	ranges := make([]ipRange, 0)
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		// P2P descriptions may contain commas, so go by whether the line
+		// starts with a range, and try the other format if that fails.
+		parse, fallback := parseP2PLine, parseDATLine
+		if isDATLine(line) {
+			parse, fallback = parseDATLine, parseP2PLine
+		}
+
+		r, err := parse(line)
+		if err != nil && err != errRangeAllowed {
+			r, err = fallback(line)
+		}
+
+		if err == errRangeAllowed {
+			continue
+		}
+		if err != nil {
+			Debugf("Skipping blocklist line %q: %s", line, err)
+			continue
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges, scanner.Err()
+}
+
+var errRangeAllowed = errors.New("range is not blocked")
+
+// isDATLine reports whether the line starts with a range followed by a comma,
+// where P2P lines start with a description.
+func isDATLine(line string) bool {
+	comma := strings.Index(line, ",")
+	if comma < 0 {
+		return false
+	}
+
+	_, err := parseRange(line[:comma])
+	return err == nil
+}
+
+func parseDATLine(line string) (ipRange, error) {
+	fields := strings.SplitN(line, ",", 3)
+
+	// Access levels above 127 mark the range as allowed.
+	if len(fields) > 1 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err == nil && level > 127 {
+			return ipRange{}, errRangeAllowed
+		}
+	}
+
+	return parseRange(fields[0])
+}
+
+func parseP2PLine(line string) (ipRange, error) {
+	dash := strings.LastIndex(line, "-")
+	if dash < 0 {
+		return ipRange{}, errors.New("missing range separator")
+	}
+
+	// Descriptions may themselves contain colons, and so may IPv6 addresses,
+	// so take the leftmost split that leaves a valid start address.
+	for i := 0; i < dash; i++ {
+		if line[i] != ':' {
+			continue
+		}
+
+		r, err := parseRange(line[i+1:])
+		if err == nil {
+			return r, nil
+		}
+	}
+
+	return ipRange{}, errors.New("invalid range")
+}
+
+func parseRange(s string) (ipRange, error) {
+	dash := strings.Index(s, "-")
+	if dash < 0 {
+		return ipRange{}, errors.New("missing range separator")
+	}
+
+	start, err := parseBlocklistAddr(s[:dash])
+	if err != nil {
+		return ipRange{}, err
+	}
+
+	end, err := parseBlocklistAddr(s[dash+1:])
+	if err != nil {
+		return ipRange{}, err
+	}
+
+	if start.Is4() != end.Is4() || end.Less(start) {
+		return ipRange{}, errors.New("invalid range bounds")
+	}
+
+	return ipRange{Start: start, End: end}, nil
+}
+
+// parseBlocklistAddr accepts the zero-padded IPv4 octets used by DAT files,
+// which the standard parsers reject.
+func parseBlocklistAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+
+	if !strings.Contains(s, ":") {
+		octets := strings.Split(s, ".")
+		for i, octet := range octets {
+			trimmed := strings.TrimLeft(octet, "0")
+			if len(trimmed) == 0 {
+				trimmed = "0"
+			}
+			octets[i] = trimmed
+		}
+		s = strings.Join(octets, ".")
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return addr.Unmap(), nil
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	blocklist := `# comment
+// another comment
+Some Org:1.2.3.4-1.2.3.5
+Foo, Inc:10.0.0.0-10.0.0.255
+Bar: Baz, LLC:2001:db8::1-2001:db8::ff
+001.002.004.000 - 001.002.004.255 , 000 , DAT range
+2001:db8:1::1 - 2001:db8:1::ff , 100 , DAT IPv6 range
+001.002.005.000 - 001.002.005.255 , 200 , allowed
+not a range
+`
+
+	ranges, err := ParseBlocklist(strings.NewReader(blocklist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 5 {
+		t.Fatalf("parsed %d ranges, want 5: %v", len(ranges), ranges)
+	}
+
+	filter := &IPFilter{ranges: mergeRanges(ranges)}
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"1.2.3.4", true},
+		{"1.2.3.6", false},
+		{"10.0.0.128", true},
+		{"2001:db8::80", true},
+		{"1.2.4.7", true},
+		{"2001:db8:1::2", true},
+		{"1.2.5.1", false},
+		{"192.0.2.1", false},
+	}
+
+	for _, test := range tests {
+		if blocked := filter.Blocked(net.ParseIP(test.ip)); blocked != test.blocked {
+			t.Errorf("Blocked(%s) = %t, want %t", test.ip, blocked, test.blocked)
+		}
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	ranges, _ := ParseBlocklist(strings.NewReader("a:1.0.0.0-1.0.0.10\nb:1.0.0.11-1.0.0.20\nc:1.0.0.5-1.0.0.6\nd:2.0.0.0-2.0.0.1\n"))
+
+	merged := mergeRanges(ranges)
+	if len(merged) != 2 || merged[0].End.String() != "1.0.0.20" {
+		t.Errorf("merged into %v, want 1.0.0.0-1.0.0.20 and 2.0.0.0-2.0.0.1", merged)
+	}
+}
@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Runs of adjacent dirty pieces are written in one call, up to this size.
+const maxCoalescedWrite = 4 << 20
+
+// CachedStorage sits in front of another storage. Verified pieces are held in
+// a write cache and written out in large sequential runs once it fills up,
+// and whole pieces read for seeding are kept in a read cache.
+type CachedStorage struct {
+	Backend     Storage
+	Torrent     TorrentFile
+	WriteLimit  int
+	ReadLimit   int
+	dirty       map[int][]byte
+	dirtyBytes  int
+	pieces      map[int]*list.Element
+	recent      *list.List
+	cachedBytes int
+	stats       CacheStats
+	lock        sync.Mutex
+}
+
+type cachedPiece struct {
+	index int
+	data  []byte
+}
+
+type CacheStats struct {
+	ReadHits      int
+	ReadMisses    int
+	Flushes       int
+	FlushedPieces int
+	Writes        int
+	FlushTime     time.Duration
+	LastFlushTime time.Duration
+}
+
+func (stats CacheStats) HitRate() float64 {
+	if stats.ReadHits+stats.ReadMisses == 0 {
+		return 0
+	}
+
+	return float64(stats.ReadHits) / float64(stats.ReadHits+stats.ReadMisses)
+}
+
+func NewCachedStorage(backend Storage, torrent TorrentFile, writeLimit int, readLimit int) *CachedStorage {
+	return &CachedStorage{
+		Backend:    backend,
+		Torrent:    torrent,
+		WriteLimit: writeLimit,
+		ReadLimit:  readLimit,
+		dirty:      make(map[int][]byte),
+		pieces:     make(map[int]*list.Element),
+		recent:     list.New(),
+	}
+}
+
+func (cache *CachedStorage) ReadAt(index int, begin int, data []byte) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	end := begin + len(data)
+	withinPiece := begin >= 0 && end <= cache.Torrent.PieceSize(index)
+
+	if piece, ok := cache.dirty[index]; ok && withinPiece {
+		cache.stats.ReadHits += 1
+		copy(data, piece[begin:end])
+		return nil
+	}
+
+	if element, ok := cache.pieces[index]; ok && withinPiece {
+		cache.stats.ReadHits += 1
+		cache.recent.MoveToFront(element)
+		copy(data, element.Value.(*cachedPiece).data[begin:end])
+		return nil
+	}
+
+	cache.stats.ReadMisses += 1
+
+	if !withinPiece || cache.ReadLimit < cache.Torrent.PieceSize(index) {
+		err := cache.flush()
+		if err != nil {
+			return err
+		}
+
+		return cache.Backend.ReadAt(index, begin, data)
+	}
+
+	// Peers usually request a piece block by block, so read all of it at once.
+	piece := make([]byte, cache.Torrent.PieceSize(index))
+	err := cache.Backend.ReadAt(index, 0, piece)
+	if err != nil {
+		return err
+	}
+
+	cache.remember(index, piece)
+	copy(data, piece[begin:end])
+
+	return nil
+}
+
+// remember adds a piece to the read cache, evicting the least recently used
+// pieces to stay under the limit.
+func (cache *CachedStorage) remember(index int, piece []byte) {
+	for cache.recent.Len() > 0 && cache.cachedBytes+len(piece) > cache.ReadLimit {
+		cache.forget(cache.recent.Back().Value.(*cachedPiece).index)
+	}
+
+	cache.pieces[index] = cache.recent.PushFront(&cachedPiece{index: index, data: piece})
+	cache.cachedBytes += len(piece)
+}
+
+func (cache *CachedStorage) forget(index int) {
+	element, ok := cache.pieces[index]
+	if !ok {
+		return
+	}
+
+	cache.recent.Remove(element)
+	delete(cache.pieces, index)
+	cache.cachedBytes -= len(element.Value.(*cachedPiece).data)
+}
+
+func (cache *CachedStorage) WriteAt(index int, begin int, data []byte) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.forget(index)
+
+	// Only whole pieces are cached, anything else is written straight through.
+	if begin != 0 || len(data) != cache.Torrent.PieceSize(index) || len(data) > cache.WriteLimit {
+		err := cache.flush()
+		if err != nil {
+			return err
+		}
+
+		return cache.Backend.WriteAt(index, begin, data)
+	}
+
+	if _, ok := cache.dirty[index]; !ok && cache.dirtyBytes+len(data) > cache.WriteLimit {
+		err := cache.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, ok := cache.dirty[index]; !ok {
+		cache.dirtyBytes += len(data)
+	}
+	cache.dirty[index] = append([]byte(nil), data...)
+
+	return nil
+}
+
+// flush writes every dirty piece to the backend, joining runs of adjacent
+// pieces into single writes.
+func (cache *CachedStorage) flush() error {
+	if len(cache.dirty) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+
+	indexes := make([]int, 0, len(cache.dirty))
+	for index := range cache.dirty {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	writes := 0
+	for i := 0; i < len(indexes); {
+		run := cache.dirty[indexes[i]]
+		first := indexes[i]
+		i++
+
+		for i < len(indexes) && indexes[i] == indexes[i-1]+1 && len(run)+len(cache.dirty[indexes[i]]) <= maxCoalescedWrite {
+			run = append(run, cache.dirty[indexes[i]]...)
+			i++
+		}
+
+		err := cache.Backend.WriteAt(first, 0, run)
+		if err != nil {
+			// Runs already written are gone from the map, the rest stay dirty.
+			cache.dirtyBytes = 0
+			for _, piece := range cache.dirty {
+				cache.dirtyBytes += len(piece)
+			}
+			return err
+		}
+		writes += 1
+
+		for index := first; index < indexes[i-1]+1; index++ {
+			delete(cache.dirty, index)
+		}
+	}
+
+	elapsed := time.Since(start)
+	cache.stats.Flushes += 1
+	cache.stats.FlushedPieces += len(indexes)
+	cache.stats.Writes += writes
+	cache.stats.FlushTime += elapsed
+	cache.stats.LastFlushTime = elapsed
+	cache.dirtyBytes = 0
+
+	Debugf("Flushed %d pieces in %d writes in %s", len(indexes), writes, elapsed)
+
+	return nil
+}
+
+func (cache *CachedStorage) Flush() error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	err := cache.flush()
+	if err != nil {
+		return err
+	}
+
+	return cache.Backend.Flush()
+}
+
+func (cache *CachedStorage) Close() error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	err := cache.flush()
+	if err != nil {
+		cache.Backend.Close()
+		return err
+	}
+
+	Debugf("Read cache hit rate %.0f%%, %d flushes taking %s", cache.stats.HitRate()*100, cache.stats.Flushes, cache.stats.FlushTime)
+
+	return cache.Backend.Close()
+}
+
+func (cache *CachedStorage) Stat() (StorageStat, error) {
+	return cache.Backend.Stat()
+}
+
+func (cache *CachedStorage) Stats() CacheStats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.stats
+}
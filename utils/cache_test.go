@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCachedStorageStats(t *testing.T) {
+	data := []byte("pieces held in the write cache, then read back by peers")
+	torrent := checkTorrent(data, 8)
+
+	backend := NewMemoryStorage(torrent)
+	cache := NewCachedStorage(backend, torrent, 1<<20, 1<<20)
+
+	for i := 0; i < torrent.NumPieces(); i++ {
+		if err := cache.WriteAt(i, 0, data[i*8:i*8+torrent.PieceSize(i)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Dirty pieces are served from the cache.
+	block := make([]byte, 4)
+	if err := cache.ReadAt(1, 2, block); err != nil || !bytes.Equal(block, data[10:14]) {
+		t.Fatalf("read %q, %v from the write cache", block, err)
+	}
+
+	if err := cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first read after flushing misses and caches the whole piece.
+	for i := 0; i < 2; i++ {
+		if err := cache.ReadAt(2, i*4, block); err != nil || !bytes.Equal(block, data[16+i*4:20+i*4]) {
+			t.Fatalf("read %q, %v", block, err)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.ReadHits != 2 || stats.ReadMisses != 1 {
+		t.Errorf("%d hits and %d misses, want 2 and 1", stats.ReadHits, stats.ReadMisses)
+	}
+	if stats.Flushes != 1 || stats.FlushedPieces != torrent.NumPieces() || stats.Writes != 1 {
+		t.Errorf("%d flushes of %d pieces in %d writes, want 1 of %d in 1", stats.Flushes, stats.FlushedPieces, stats.Writes, torrent.NumPieces())
+	}
+
+	download := &Download{Torrent: torrent, Storage: cache, Bans: NewBanList(), Hashes: NewHashPool(1, nil)}
+	defer download.Hashes.Close()
+
+	if status := download.Status(); status.Cache != stats {
+		t.Errorf("status shows cache stats %+v, want %+v", status.Cache, stats)
+	}
+
+	if shown := Cache(Status{Cache: stats}); !strings.HasPrefix(shown, "  (67% cache hits, last flush") {
+		t.Errorf("display shows %q", shown)
+	}
+}
+
+// failingStorage fails writes starting at one piece.
+type failingStorage struct {
+	Storage
+	failAt int
+}
+
+func (storage *failingStorage) WriteAt(index int, begin int, data []byte) error {
+	if index == storage.failAt {
+		return errors.New("disk full")
+	}
+
+	return storage.Storage.WriteAt(index, begin, data)
+}
+
+func TestCachedStorageFailedFlush(t *testing.T) {
+	data := []byte("pieces that don't all make it to disk")
+	torrent := checkTorrent(data, 8)
+
+	backend := &failingStorage{Storage: NewMemoryStorage(torrent), failAt: 2}
+	cache := NewCachedStorage(backend, torrent, 1<<20, 1<<20)
+
+	// Pieces 0 and 2 aren't adjacent, so they are written separately.
+	cache.WriteAt(0, 0, data[0:8])
+	cache.WriteAt(2, 0, data[16:24])
+
+	if err := cache.Flush(); err == nil {
+		t.Fatal("flush succeeded though the backend failed")
+	}
+	if len(cache.dirty) != 1 || cache.dirtyBytes != 8 {
+		t.Errorf("%d dirty pieces of %d bytes after a failed flush, want 1 of 8", len(cache.dirty), cache.dirtyBytes)
+	}
+
+	backend.failAt = -1
+	if err := cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.dirty) != 0 || cache.dirtyBytes != 0 {
+		t.Errorf("%d dirty pieces of %d bytes after flushing", len(cache.dirty), cache.dirtyBytes)
+	}
+}
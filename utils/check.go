@@ -0,0 +1,63 @@
+package utils
+
+import "sync"
+
+// CheckExisting verifies data already on disk, left by an earlier run or put
+// there to seed, and marks the pieces that are intact as completed.
+func (download *Download) CheckExisting() error {
+	if _, ok := asDiskStorage(download.Storage); !ok {
+		return nil
+	}
+
+	stat, err := download.Storage.Stat()
+	if err != nil || stat.Bytes == 0 {
+		return err
+	}
+
+	var wait sync.WaitGroup
+	for i := 0; i < download.Torrent.NumPieces(); i++ {
+		index := i
+		piece := make([]byte, download.Torrent.PieceSize(index))
+
+		err := download.Storage.ReadAt(index, 0, piece)
+		if err != nil {
+			continue
+		}
+
+		wait.Add(1)
+		err = download.Hashes.Submit(index, piece, func(valid bool) {
+			defer wait.Done()
+
+			if !valid {
+				return
+			}
+
+			download.lock.Lock()
+			download.CompletedPieces += 1
+			download.Have.SetPiece(index)
+			download.lock.Unlock()
+		})
+		if err != nil {
+			wait.Done()
+			return err
+		}
+	}
+
+	// Pieces still queued when the pool closes are never verified, so don't
+	// wait for them then.
+	verified := make(chan struct{})
+	go func() {
+		wait.Wait()
+		close(verified)
+	}()
+
+	select {
+	case <-verified:
+	case <-download.Hashes.quit:
+		return errHashPoolClosed
+	}
+
+	Debugf("Found %d of %d pieces on disk", download.CompletedPieces, download.Torrent.NumPieces())
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckExisting(t *testing.T) {
+	data := []byte("some data that is already on disk, split into pieces")
+	torrent := checkTorrent(data, 16)
+
+	storage := NewFileStorage(torrent, t.TempDir(), "")
+	defer storage.Close()
+
+	// Write every piece but the second.
+	for i := 0; i < torrent.NumPieces(); i++ {
+		piece := data[i*16 : i*16+torrent.PieceSize(i)]
+		if i == 1 {
+			piece = make([]byte, len(piece))
+		}
+
+		if err := storage.WriteAt(i, 0, piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	download := &Download{
+		Torrent: torrent,
+		Storage: storage,
+		Have:    CreateBitfield(torrent.NumPieces()),
+		Hashes:  NewHashPool(2, torrent.VerifyPiece),
+	}
+	defer download.Hashes.Close()
+
+	if err := download.CheckExisting(); err != nil {
+		t.Fatal(err)
+	}
+
+	if download.CompletedPieces != torrent.NumPieces()-1 {
+		t.Errorf("found %d pieces, want %d", download.CompletedPieces, torrent.NumPieces()-1)
+	}
+	if download.Have.HasPiece(1) || !download.Have.HasPiece(0) {
+		t.Error("marked the wrong pieces as present")
+	}
+}
+
+func TestCheckExistingClosedPool(t *testing.T) {
+	data := make([]byte, 1024)
+	torrent := checkTorrent(data, 16)
+
+	storage := NewFileStorage(torrent, t.TempDir(), "")
+	defer storage.Close()
+
+	for i := 0; i < torrent.NumPieces(); i++ {
+		if err := storage.WriteAt(i, 0, data[:16]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hashes := NewHashPool(1, torrent.VerifyPiece)
+	hashes.Close()
+
+	download := &Download{Torrent: torrent, Storage: storage, Have: CreateBitfield(torrent.NumPieces()), Hashes: hashes}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- download.CheckExisting()
+	}()
+
+	select {
+	case err := <-result:
+		if err != errHashPoolClosed {
+			t.Errorf("got error %v, want %v", err, errHashPoolClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("checking existing data hung after the hash pool closed")
+	}
+}
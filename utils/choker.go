@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	chokeInterval = 10 * time.Second
+
+	// The optimistic unchoke moves on every third round, so every 30 seconds.
+	optimisticRounds = 3
+
+	keepAliveInterval = 90 * time.Second
+)
+
+// Choker decides which interested peers may download from us. Each round it
+// unchokes the peers we download from fastest, or while seeding the ones the
+// seeding algorithm picks, plus optimistic unchokes that give other peers a
+// chance to show what they can do.
+type Choker struct {
+	Slots           int
+	OptimisticSlots int
+
+	// Seeding is the algorithm used once the download is complete:
+	// "fastest-upload" favours the peers we upload to fastest, and
+	// "round-robin" the ones we've uploaded least to.
+	Seeding string
+
+	download   *Download
+	optimistic map[*Peer]bool
+	round      int
+	lastRound  time.Time
+	wake       chan struct{}
+	quit       chan struct{}
+}
+
+func (download *Download) StartChoker(slots int, optimisticSlots int, seeding string) error {
+	if seeding != "fastest-upload" && seeding != "round-robin" {
+		return fmt.Errorf("unknown seeding choker: %s", seeding)
+	}
+
+	choker := &Choker{
+		Slots:           slots,
+		OptimisticSlots: optimisticSlots,
+		Seeding:         seeding,
+		download:        download,
+		optimistic:      make(map[*Peer]bool),
+		lastRound:       time.Now(),
+		wake:            make(chan struct{}, 1),
+		quit:            make(chan struct{}),
+	}
+	download.Choker = choker
+
+	go choker.run()
+
+	return nil
+}
+
+// Wake runs a round early, without moving the optimistic unchoke on, so newly
+// interested peers don't wait for a free slot.
+func (choker *Choker) Wake() {
+	select {
+	case choker.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (choker *Choker) Stop() {
+	close(choker.quit)
+}
+
+func (choker *Choker) run() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			choker.round += 1
+			choker.updateRates()
+			choker.keepAlive()
+			choker.rechoke(choker.round%optimisticRounds == 0)
+		case <-choker.wake:
+			choker.rechoke(false)
+		case <-choker.quit:
+			return
+		}
+	}
+}
+
+func (choker *Choker) updateRates() {
+	seconds := time.Since(choker.lastRound).Seconds()
+	choker.lastRound = time.Now()
+
+	for _, peer := range choker.download.Peers() {
+		session := peer.session
+		session.lock.Lock()
+		session.downloadRate = float64(session.downloaded-session.lastDownloaded) / seconds
+		session.uploadRate = float64(session.uploaded-session.lastUploaded) / seconds
+		session.lastDownloaded = session.downloaded
+		session.lastUploaded = session.uploaded
+		session.lock.Unlock()
+	}
+}
+
+// keepAlive writes to peers we haven't sent anything for a while, so they
+// don't drop the connection.
+func (choker *Choker) keepAlive() {
+	for _, peer := range choker.download.Peers() {
+		peer.session.writeLock.Lock()
+		idle := time.Since(peer.session.lastWrite) > keepAliveInterval
+		peer.session.writeLock.Unlock()
+
+		if idle {
+			go peer.write(make([]byte, 4))
+		}
+	}
+}
+
+func (choker *Choker) rechoke(rotate bool) {
+	peers := choker.download.Peers()
+
+	interested := make([]*Peer, 0, len(peers))
+	for _, peer := range peers {
+		peer.session.lock.Lock()
+		if peer.session.interested {
+			interested = append(interested, peer)
+		}
+		peer.session.lock.Unlock()
+	}
+
+	ranked := choker.rank(interested)
+
+	unchoke := make(map[*Peer]bool)
+	for i := 0; i < len(ranked) && i < choker.Slots; i++ {
+		unchoke[ranked[i]] = true
+	}
+
+	// Keep optimistic unchokes until they rotate, unless they left, lost
+	// interest or earned a regular slot, then fill any free slots at random.
+	if rotate {
+		choker.optimistic = make(map[*Peer]bool)
+	}
+
+	candidates := make([]*Peer, 0)
+	for _, peer := range ranked {
+		if unchoke[peer] {
+			delete(choker.optimistic, peer)
+		} else if !choker.optimistic[peer] {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	for peer := range choker.optimistic {
+		if !containsPeer(ranked, peer) {
+			delete(choker.optimistic, peer)
+		}
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for _, peer := range candidates {
+		if len(choker.optimistic) >= choker.OptimisticSlots {
+			break
+		}
+
+		Debugf("Optimistically unchoking %s", peer)
+		choker.optimistic[peer] = true
+	}
+
+	for peer := range choker.optimistic {
+		unchoke[peer] = true
+	}
+
+	for _, peer := range peers {
+		peer.setUnchoking(unchoke[peer])
+	}
+}
+
+// rank orders peers by how much they deserve a regular unchoke slot.
+func (choker *Choker) rank(peers []*Peer) []*Peer {
+	type ranking struct {
+		peer  *Peer
+		score float64
+	}
+
+	seeding := choker.download.Complete()
+
+	rankings := make([]ranking, len(peers))
+	for i, peer := range peers {
+		session := peer.session
+		session.lock.Lock()
+		switch {
+		case !seeding:
+			rankings[i] = ranking{peer, session.downloadRate}
+		case choker.Seeding == "round-robin":
+			rankings[i] = ranking{peer, -float64(session.uploaded)}
+		default:
+			rankings[i] = ranking{peer, session.uploadRate}
+		}
+		session.lock.Unlock()
+	}
+
+	sort.SliceStable(rankings, func(i, j int) bool {
+		return rankings[i].score > rankings[j].score
+	})
+
+	ranked := make([]*Peer, len(rankings))
+	for i, ranking := range rankings {
+		ranked[i] = ranking.peer
+	}
+
+	return ranked
+}
+
+func containsPeer(peers []*Peer, target *Peer) bool {
+	for _, peer := range peers {
+		if peer == target {
+			return true
+		}
+	}
+
+	return false
+}
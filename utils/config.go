@@ -1,22 +1,82 @@
 package utils
 
-import "flag"
+import (
+	"flag"
+	"os"
+	"strings"
+)
 
 var (
 	initialized bool
+	command     string
 	debug       bool
 	filePath    string
+	port        int
+	blocklists  string
+	trackerAddr string
+	whitelist   string
+	storage     string
+	preallocate string
+	savePath    string
+	incomplete  string
+	writeCache  int
+	readCache   int
+	encryption  string
+	cryptoLevel string
+	utp         bool
+	uploadSlots int
+	optimistic  int
+	seedChoker  string
+	seed        bool
+	superSeed   bool
+	lsd         bool
+	lsdIface    string
 )
 
 func InitFlags() {
 	flag.BoolVar(&debug, "debug", false, "enable debug logs")
 	flag.StringVar(&filePath, "file", "", "torrent file path")
+	flag.IntVar(&port, "port", 1337, "port to listen on for incoming peers")
+	flag.StringVar(&blocklists, "blocklist", "", "comma-separated blocklist files or URLs (P2P or DAT format)")
+	flag.StringVar(&trackerAddr, "tracker-addr", ":6969", "address the tracker command serves HTTP and UDP on")
+	flag.StringVar(&whitelist, "whitelist", "", "file of hex info hashes the tracker command will serve")
+	flag.StringVar(&storage, "storage", "file", "where to store downloaded data: file, mmap or memory")
+	flag.StringVar(&savePath, "save-path", "downloads", "directory completed downloads are saved in")
+	flag.StringVar(&incomplete, "incomplete-dir", "", "directory to keep downloads in, with a .part suffix, until they complete")
+	flag.StringVar(&encryption, "encryption", "prefer", "peer connection encryption: prefer, require or disable")
+	flag.StringVar(&cryptoLevel, "encryption-level", "both", "what encryption covers: full (RC4), header (handshake only) or both")
+	flag.BoolVar(&utp, "utp", true, "connect to and accept peers over uTP as well as TCP")
+	flag.BoolVar(&lsd, "lsd", true, "find peers on the local network with multicast announces")
+	flag.StringVar(&lsdIface, "lsd-interface", "", "network interface for local peer discovery, e.g. lo (default: the system's choice)")
+	flag.IntVar(&writeCache, "write-cache", 32, "MiB of verified pieces to hold before writing them to disk")
+	flag.IntVar(&readCache, "read-cache", 32, "MiB of pieces to keep in memory for serving to peers")
+	flag.StringVar(&preallocate, "preallocate", "none", "reserve disk space up front: none, sparse or full")
+	flag.IntVar(&uploadSlots, "upload-slots", 4, "peers to upload to at once, picked by how fast they give back")
+	flag.IntVar(&optimistic, "optimistic-slots", 1, "extra peers to upload to at random, rotated every 30 seconds")
+	flag.StringVar(&seedChoker, "seed-choker", "fastest-upload", "who to upload to when seeding: fastest-upload or round-robin")
+	flag.BoolVar(&seed, "seed", false, "keep seeding once the download completes, until interrupted")
+	flag.BoolVar(&superSeed, "super-seed", false, "seed revealing one piece per peer at a time, to upload as little as possible (implies --seed)")
+
+	// An optional command may precede the flags, e.g. "scrape --file x".
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 
 	initialized = true
 }
 
+func GetCommand() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return command
+}
+
 func GetDebug() bool {
 	if !initialized {
 		InitFlags()
@@ -32,3 +92,172 @@ func GetFilePath() string {
 
 	return filePath
 }
+
+func GetPort() uint16 {
+	if !initialized {
+		InitFlags()
+	}
+
+	return uint16(port)
+}
+
+func GetBlocklists() []string {
+	if !initialized {
+		InitFlags()
+	}
+
+	sources := make([]string, 0)
+	for _, source := range strings.Split(blocklists, ",") {
+		if source = strings.TrimSpace(source); len(source) > 0 {
+			sources = append(sources, source)
+		}
+	}
+
+	return sources
+}
+
+func GetTrackerAddr() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return trackerAddr
+}
+
+func GetWhitelist() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return whitelist
+}
+
+func GetStorage() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return storage
+}
+
+func GetPreallocate() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return preallocate
+}
+
+func GetSavePath() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return savePath
+}
+
+func GetIncompleteDir() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return incomplete
+}
+
+// GetWriteCache returns the write cache size in bytes.
+func GetWriteCache() int {
+	if !initialized {
+		InitFlags()
+	}
+
+	return writeCache << 20
+}
+
+// GetReadCache returns the read cache size in bytes.
+func GetReadCache() int {
+	if !initialized {
+		InitFlags()
+	}
+
+	return readCache << 20
+}
+
+func GetEncryption() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return encryption
+}
+
+func GetEncryptionLevel() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return cryptoLevel
+}
+
+func GetUTP() bool {
+	if !initialized {
+		InitFlags()
+	}
+
+	return utp
+}
+
+func GetUploadSlots() int {
+	if !initialized {
+		InitFlags()
+	}
+
+	return uploadSlots
+}
+
+func GetOptimisticSlots() int {
+	if !initialized {
+		InitFlags()
+	}
+
+	return optimistic
+}
+
+func GetSeedChoker() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return seedChoker
+}
+
+func GetSeed() bool {
+	if !initialized {
+		InitFlags()
+	}
+
+	return seed
+}
+
+func GetSuperSeed() bool {
+	if !initialized {
+		InitFlags()
+	}
+
+	return superSeed
+}
+
+func GetLSD() bool {
+	if !initialized {
+		InitFlags()
+	}
+
+	return lsd
+}
+
+func GetLSDInterface() string {
+	if !initialized {
+		InitFlags()
+	}
+
+	return lsdIface
+}
@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain sets up the flags with their defaults up front, since the lazy
+// initialisation in the getters isn't safe to race.
+func TestMain(m *testing.M) {
+	InitFlags()
+	os.Exit(m.Run())
+}
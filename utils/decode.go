@@ -4,15 +4,24 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/jackpal/bencode-go"
 )
 
 type BencodeFile struct {
-	Length int      `bencode:"length"`
-	Path   []string `beconde:"path"`
+	Length      int      `bencode:"length"`
+	Path        []string `bencode:"path"`
+	PathUTF8    []string `bencode:"path.utf-8"`
+	Attr        string   `bencode:"attr"`
+	SymlinkPath []string `bencode:"symlink path"`
+	SHA1        string   `bencode:"sha1"`
 }
 
 type BencodeInfo struct {
@@ -21,6 +30,9 @@ type BencodeInfo struct {
 	PieceLength int           `bencode:"piece length"`
 	Length      int           `bencode:"length"`
 	Name        string        `bencode:"name"`
+	NameUTF8    string        `bencode:"name.utf-8"`
+	MetaVersion int           `bencode:"meta version"`
+	Private     int           `bencode:"private"`
 }
 
 type BencodeTorrent struct {
@@ -35,23 +47,68 @@ type BencodePeer struct {
 }
 
 type BencodeAnnounce struct {
-	Interval int           `bencode:"interval"`
-	Peers    []BencodePeer `bencode:"peers"`
+	FailureReason  string        `bencode:"failure reason"`
+	WarningMessage string        `bencode:"warning message"`
+	Interval       int           `bencode:"interval"`
+	MinInterval    int           `bencode:"min interval"`
+	TrackerID      string        `bencode:"tracker id"`
+	Complete       int           `bencode:"complete"`
+	Incomplete     int           `bencode:"incomplete"`
+	Peers          []BencodePeer `bencode:"peers"`
+	CompactPeers   string        `bencode:"-"`
+	CompactPeers6  string        `bencode:"peers6"`
+}
+
+// BencodeCompactAnnounce picks up the BEP 23 form of peers, a binary string,
+// which can't share a field with the dictionary form.
+type BencodeCompactAnnounce struct {
+	Peers string `bencode:"peers"`
 }
 
 type File struct {
-	Length int
-	Path   []string
+	Length      int
+	Path        []string
+	Padding     bool
+	Executable  bool
+	Hidden      bool
+	Symlink     bool
+	SymlinkPath []string
+	SHA1        []byte
+	PiecesRoot  [32]byte
+}
+
+// SetAttributes applies the BEP 47 attr string: p(adding), x (executable),
+// h(idden) and l (symlink).
+func (file *File) SetAttributes(attr string) {
+	file.Padding = strings.Contains(attr, "p")
+	file.Executable = strings.Contains(attr, "x")
+	file.Hidden = strings.Contains(attr, "h")
+	file.Symlink = strings.Contains(attr, "l")
 }
 
+// TorrentFile describes v1, v2 (BEP 52) and hybrid torrents. InfoHash is the
+// hash used on the wire: the SHA-1 info hash for v1 and hybrid torrents, and the
+// truncated SHA-256 info hash for v2-only torrents.
 type TorrentFile struct {
-	AnnounceList []string
+	AnnounceList [][]string
 	InfoHash     [20]byte
+	InfoHashV2   [32]byte
+	MetaVersion  int
 	PieceHash    [][20]byte
+	PieceLayers  map[[32]byte][][32]byte
+	PiecesRoot   [32]byte
 	PieceLength  int
 	Length       int
 	Name         string
 	Files        []File
+	URLList      []string
+	HTTPSeeds    []string
+
+	// Private torrents (BEP 27) only get peers from their trackers.
+	Private bool
+
+	// Info is the bencoded info dictionary, which peers can fetch as metadata.
+	Info []byte
 }
 
 func DecodeBencodedFile(file *os.File) (TorrentFile, error) {
@@ -76,18 +133,265 @@ func DecodeBencodedFile(file *os.File) (TorrentFile, error) {
 		bencode.Marshal(&infoBuffer, decodedMap["info"])
 
 		torrent.InfoHash = sha1.Sum(infoBuffer.Bytes())
+		torrent.InfoHashV2 = sha256.Sum256(infoBuffer.Bytes())
+		torrent.Info = infoBuffer.Bytes()
+
+		// Web seed keys may hold a single URL or a list of URLs.
+		torrent.URLList = bencodeStrings(decodedMap["url-list"])
+		torrent.HTTPSeeds = bencodeStrings(decodedMap["httpseeds"])
+
+		if torrent.MetaVersion == 2 {
+			info, _ := decodedMap["info"].(map[string]any)
+			layers, _ := decodedMap["piece layers"].(map[string]any)
+
+			err = torrent.decodeV2(info, layers)
+			if err != nil {
+				return TorrentFile{}, err
+			}
+		}
+	}
+
+	err = torrent.ValidatePaths()
+	if err != nil {
+		return TorrentFile{}, err
 	}
 
 	return torrent, nil
 }
 
+// decodeV2 reads the BEP 52 file tree and piece layers. Hybrid torrents keep
+// their v1 file list and SHA-1 piece hashes, which describe the same layout.
+func (torrent *TorrentFile) decodeV2(info map[string]any, layers map[string]any) error {
+	if torrent.PieceLength < merkleBlockSize || torrent.PieceLength != nextPowerOfTwo(torrent.PieceLength) {
+		return errors.New("v2 piece length must be a power of two of at least 16 KiB")
+	}
+
+	fileTree, ok := info["file tree"].(map[string]any)
+	if !ok {
+		return errors.New("v2 torrent is missing its file tree")
+	}
+	files := decodeFileTree(fileTree, nil)
+
+	torrent.PieceLayers = make(map[[32]byte][][32]byte)
+	for root, layer := range layers {
+		hashes, ok := layer.(string)
+		if len(root) != 32 || !ok || len(hashes)%32 != 0 {
+			return errors.New("invalid piece layers")
+		}
+
+		var piecesRoot [32]byte
+		copy(piecesRoot[:], root)
+		for i := 0; i < len(hashes); i += 32 {
+			var hash [32]byte
+			copy(hash[:], hashes[i:i+32])
+			torrent.PieceLayers[piecesRoot] = append(torrent.PieceLayers[piecesRoot], hash)
+		}
+	}
+
+	for _, file := range files {
+		err := torrent.validatePieceLayer(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(file.Path, "/"), err)
+		}
+	}
+
+	if len(torrent.PieceHash) > 0 {
+		return nil
+	}
+
+	// A v2-only torrent is addressed on the wire by its truncated v2 info hash.
+	copy(torrent.InfoHash[:], torrent.InfoHashV2[:20])
+
+	if len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == torrent.Name {
+		torrent.Length = files[0].Length
+		torrent.PiecesRoot = files[0].PiecesRoot
+		return nil
+	}
+
+	// Every v2 file starts on a piece boundary, which we model as padding
+	// between files so that piece offsets line up as they do in v1.
+	torrent.Files = make([]File, 0)
+	torrent.Length = 0
+	for i, file := range files {
+		torrent.Files = append(torrent.Files, file)
+		torrent.Length += file.Length
+
+		remainder := file.Length % torrent.PieceLength
+		if remainder != 0 && i < len(files)-1 {
+			padding := torrent.PieceLength - remainder
+			torrent.Files = append(torrent.Files, File{Length: padding, Padding: true})
+			torrent.Length += padding
+		}
+	}
+
+	return nil
+}
+
+func decodeFileTree(node map[string]any, path []string) []File {
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]File, 0)
+	for _, name := range names {
+		child, ok := node[name].(map[string]any)
+		if !ok {
+			continue
+		}
+
+		childPath := append(append([]string{}, path...), name)
+
+		leaf, ok := child[""].(map[string]any)
+		if !ok {
+			files = append(files, decodeFileTree(child, childPath)...)
+			continue
+		}
+
+		file := File{Length: bencodeInt(leaf["length"]), Path: childPath}
+		if root, ok := leaf["pieces root"].(string); ok && len(root) == 32 {
+			copy(file.PiecesRoot[:], root)
+		}
+
+		attr, _ := leaf["attr"].(string)
+		file.SetAttributes(attr)
+		file.SymlinkPath = bencodeStrings(leaf["symlink path"])
+
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// validatePieceLayer checks that a file's piece layer hashes up to its pieces
+// root. Files no longer than a piece have no layer; their root is checked
+// directly against the data.
+func (torrent TorrentFile) validatePieceLayer(file File) error {
+	if file.Length <= torrent.PieceLength {
+		return nil
+	}
+
+	layer, ok := torrent.PieceLayers[file.PiecesRoot]
+	numPieces := (file.Length + torrent.PieceLength - 1) / torrent.PieceLength
+	if !ok || len(layer) != numPieces {
+		return errors.New("missing piece layer")
+	}
+
+	pad := zeroSubtreeRoot(torrent.PieceLength / merkleBlockSize)
+	if merkleRoot(layer, nextPowerOfTwo(numPieces), pad) != file.PiecesRoot {
+		return errors.New("piece layer does not match pieces root")
+	}
+
+	return nil
+}
+
+func (torrent TorrentFile) NumPieces() int {
+	if len(torrent.PieceHash) > 0 {
+		return len(torrent.PieceHash)
+	}
+
+	if torrent.PieceLength == 0 {
+		return 0
+	}
+
+	return (torrent.Length + torrent.PieceLength - 1) / torrent.PieceLength
+}
+
+// PieceSize is the length of a piece, which is shorter than PieceLength only
+// for the last one.
+func (torrent TorrentFile) PieceSize(index int) int {
+	remainingBytes := torrent.Length - (index * torrent.PieceLength)
+	if remainingBytes < torrent.PieceLength {
+		return remainingBytes
+	}
+
+	return torrent.PieceLength
+}
+
+// MatchesInfoHash reports whether a peer's handshake is for this torrent. Hybrid
+// torrents can be joined through either of their info hashes.
+func (torrent TorrentFile) MatchesInfoHash(infoHash []byte) bool {
+	if bytes.Equal(torrent.InfoHash[:], infoHash) {
+		return true
+	}
+
+	return torrent.MetaVersion == 2 && bytes.Equal(torrent.InfoHashV2[:20], infoHash)
+}
+
+func (torrent TorrentFile) VerifyPiece(index int, piece []byte) bool {
+	if len(torrent.PieceHash) > 0 {
+		return sha1.Sum(piece) == torrent.PieceHash[index]
+	}
+
+	// A v2 piece never spans files, so there's one range of real data followed
+	// at most by padding.
+	for _, fileRange := range torrent.FileRanges(index*torrent.PieceLength, len(piece)) {
+		if fileRange.Padding {
+			continue
+		}
+
+		root, length := torrent.PiecesRoot, torrent.Length
+		if fileRange.FileIndex >= 0 {
+			file := torrent.Files[fileRange.FileIndex]
+			root, length = file.PiecesRoot, file.Length
+		}
+
+		leaves := merkleLeaves(piece[fileRange.PieceOffset : fileRange.PieceOffset+fileRange.Length])
+
+		if length <= torrent.PieceLength {
+			return merkleRoot(leaves, nextPowerOfTwo(len(leaves)), [32]byte{}) == root
+		}
+
+		layer := torrent.PieceLayers[root]
+		layerIndex := fileRange.FileOffset / torrent.PieceLength
+		if layerIndex >= len(layer) {
+			return false
+		}
+
+		return merkleRoot(leaves, torrent.PieceLength/merkleBlockSize, [32]byte{}) == layer[layerIndex]
+	}
+
+	return false
+}
+
+func bencodeStrings(value any) []string {
+	switch v := value.(type) {
+	case string:
+		if len(v) > 0 {
+			return []string{v}
+		}
+	case []any:
+		strs := make([]string, 0, len(v))
+		for _, item := range v {
+			if str, ok := item.(string); ok && len(str) > 0 {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+	}
+
+	return nil
+}
+
 func Announce(r io.Reader) (*BencodeAnnounce, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
 	ba := BencodeAnnounce{}
-	err := bencode.Unmarshal(r, &ba)
+	err = bencode.Unmarshal(bytes.NewReader(body), &ba)
+	if err != nil {
+		return nil, err
+	}
 
+	bca := BencodeCompactAnnounce{}
+	err = bencode.Unmarshal(bytes.NewReader(body), &bca)
 	if err != nil {
 		return nil, err
 	}
+	ba.CompactPeers = bca.Peers
 
 	return &ba, nil
 }
@@ -100,20 +404,50 @@ func (b BencodeTorrent) ToTorrentFile() TorrentFile {
 		hashes = append(hashes, hash)
 	}
 
-	announceList := []string{b.Announce}
-	for _, announceUrl := range b.AnnounceList {
-		announceList = append(announceList, announceUrl...)
+	// Per BEP 12, announce is only used when there is no announce-list.
+	announceList := make([][]string, 0)
+	for _, tier := range b.AnnounceList {
+		if len(tier) > 0 {
+			announceList = append(announceList, tier)
+		}
+	}
+	if len(announceList) == 0 && len(b.Announce) > 0 {
+		announceList = append(announceList, []string{b.Announce})
 	}
 
 	length := b.Info.Length
 	files := make([]File, 0)
 	for _, file := range b.Info.Files {
-		files = append(files, File(file))
+		// Older clients wrote names in the local code page, with a UTF-8 copy alongside.
+		path := file.Path
+		if len(file.PathUTF8) > 0 {
+			path = file.PathUTF8
+		}
+
+		torrentFile := File{Length: file.Length, Path: path, SymlinkPath: file.SymlinkPath}
+		torrentFile.SetAttributes(file.Attr)
+
+		// BitComet marked padding by name before BEP 47 existed.
+		if len(path) > 0 && strings.HasPrefix(path[len(path)-1], "_____padding_file_") {
+			torrentFile.Padding = true
+		}
+		if len(file.SHA1) == 20 {
+			torrentFile.SHA1 = []byte(file.SHA1)
+		}
+
+		files = append(files, torrentFile)
 		length += file.Length
 	}
 
+	name := b.Info.Name
+	if len(b.Info.NameUTF8) > 0 {
+		name = b.Info.NameUTF8
+	}
+
 	return TorrentFile{
-		Name:         b.Info.Name,
+		Name:         name,
+		MetaVersion:  b.Info.MetaVersion,
+		Private:      b.Info.Private == 1,
 		PieceLength:  b.Info.PieceLength,
 		AnnounceList: announceList,
 		Length:       length,
@@ -121,3 +455,54 @@ func (b BencodeTorrent) ToTorrentFile() TorrentFile {
 		Files:        files,
 	}
 }
+
+type FileRange struct {
+	Path        []string
+	FileIndex   int
+	FileOffset  int
+	PieceOffset int
+	Length      int
+	Padding     bool
+}
+
+// FileRanges maps a span of the torrent's data onto the files it covers. Paths
+// start with the torrent name, which for single-file torrents is the file itself.
+func (torrent TorrentFile) FileRanges(offset int, length int) []FileRange {
+	if len(torrent.Files) == 0 {
+		return []FileRange{{Path: []string{torrent.Name}, FileIndex: -1, FileOffset: offset, Length: length}}
+	}
+
+	fileRanges := make([]FileRange, 0)
+	fileOffset := 0
+	end := offset + length
+
+	for i, file := range torrent.Files {
+		fileMin := fileOffset
+		fileMax := fileMin + file.Length
+		fileOffset = fileMax
+
+		if fileMax <= offset || fileMin >= end {
+			continue
+		}
+
+		rangeStart := offset
+		if fileMin > rangeStart {
+			rangeStart = fileMin
+		}
+		rangeEnd := end
+		if fileMax < rangeEnd {
+			rangeEnd = fileMax
+		}
+
+		fileRanges = append(fileRanges, FileRange{
+			Path:        append([]string{torrent.Name}, file.Path...),
+			FileIndex:   i,
+			FileOffset:  rangeStart - fileMin,
+			PieceOffset: rangeStart - offset,
+			Length:      rangeEnd - rangeStart,
+			Padding:     file.Padding,
+		})
+	}
+
+	return fileRanges
+}
@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const maxOpenFiles = 64
+
+// FileStorage writes the torrent's files under a root directory, keeping the
+// most recently used file handles open.
+type FileStorage struct {
+	Torrent TorrentFile
+	Root    string
+	Suffix  string
+	handles map[string]*list.Element
+	recent  *list.List
+	closed  bool
+	lock    sync.Mutex
+}
+
+type fileHandle struct {
+	path     string
+	file     *os.File
+	writable bool
+}
+
+func NewFileStorage(torrent TorrentFile, root string, suffix string) *FileStorage {
+	return &FileStorage{
+		Torrent: torrent,
+		Root:    root,
+		Suffix:  suffix,
+		handles: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+func (storage *FileStorage) FilePath(path []string) string {
+	return storagePath(storage.Root, path, storage.Suffix)
+}
+
+func (storage *FileStorage) ReadAt(index int, begin int, data []byte) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	for _, fileRange := range storageRanges(storage.Torrent, index, begin, len(data)) {
+		file, err := storage.open(fileRange, false)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.ReadAt(data[fileRange.PieceOffset:fileRange.PieceOffset+fileRange.Length], int64(fileRange.FileOffset))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (storage *FileStorage) WriteAt(index int, begin int, data []byte) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	for _, fileRange := range storageRanges(storage.Torrent, index, begin, len(data)) {
+		file, err := storage.open(fileRange, true)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.WriteAt(data[fileRange.PieceOffset:fileRange.PieceOffset+fileRange.Length], int64(fileRange.FileOffset))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// open returns a handle for the file a range falls in, closing the least
+// recently used handle if too many are open. Files are only created for
+// writing, so reading one that doesn't exist yet fails with os.ErrNotExist.
+func (storage *FileStorage) open(fileRange FileRange, write bool) (*os.File, error) {
+	if storage.closed {
+		return nil, errors.New("storage is closed")
+	}
+
+	path := storage.FilePath(fileRange.Path)
+	if element, ok := storage.handles[path]; ok {
+		handle := element.Value.(*fileHandle)
+		if handle.writable || !write {
+			storage.recent.MoveToFront(element)
+			return handle.file, nil
+		}
+
+		// Files only read so far are reopened for writing.
+		storage.recent.Remove(element)
+		delete(storage.handles, path)
+		handle.file.Close()
+	}
+
+	var file *os.File
+	var err error
+	if write {
+		file, err = createFile(path, storage.Torrent, fileRange)
+	} else {
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if storage.recent.Len() >= maxOpenFiles {
+		oldest := storage.recent.Back()
+		storage.recent.Remove(oldest)
+		delete(storage.handles, oldest.Value.(*fileHandle).path)
+		oldest.Value.(*fileHandle).file.Close()
+	}
+
+	storage.handles[path] = storage.recent.PushFront(&fileHandle{path: path, file: file, writable: write})
+
+	return file, nil
+}
+
+// createFile opens a file for reading and writing, creating it and its
+// directory if needed.
+func createFile(path string, torrent TorrentFile, fileRange FileRange) (*os.File, error) {
+	perm := os.FileMode(0666)
+	if fileRange.FileIndex >= 0 && torrent.Files[fileRange.FileIndex].Executable {
+		perm = 0777
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, perm)
+}
+
+func (storage *FileStorage) Flush() error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	for element := storage.recent.Front(); element != nil; element = element.Next() {
+		handle := element.Value.(*fileHandle)
+		if !handle.writable {
+			continue
+		}
+
+		err := handle.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (storage *FileStorage) Close() error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	err := storage.closeHandles()
+	storage.closed = true
+
+	return err
+}
+
+// Move closes every handle and moves the files to their final names under
+// root. Handles are reopened there on the next read or write.
+func (storage *FileStorage) Move(root string, progress func(moved int64, total int64)) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	err := storage.closeHandles()
+	if err != nil {
+		return err
+	}
+
+	err = moveStored(storage.Torrent, storage.Root, storage.Suffix, root, progress)
+	if err != nil {
+		return err
+	}
+
+	storage.Root = root
+	storage.Suffix = ""
+
+	return nil
+}
+
+func (storage *FileStorage) closeHandles() error {
+	var firstErr error
+	for element := storage.recent.Front(); element != nil; element = element.Next() {
+		err := element.Value.(*fileHandle).file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	storage.handles = make(map[string]*list.Element)
+	storage.recent.Init()
+
+	return firstErr
+}
+
+func (storage *FileStorage) Stat() (StorageStat, error) {
+	return statFiles(storage.Torrent, storage.FilePath)
+}
+
+// statFiles counts the torrent's files that exist on disk and their size.
+func statFiles(torrent TorrentFile, filePath func(path []string) string) (StorageStat, error) {
+	stat := StorageStat{}
+
+	for _, fileRange := range torrent.FileRanges(0, torrent.Length) {
+		if fileRange.Padding {
+			continue
+		}
+
+		info, err := os.Stat(filePath(fileRange.Path))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return stat, err
+		}
+
+		stat.Files += 1
+		stat.Bytes += info.Size()
+	}
+
+	return stat, nil
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStorageReadsDontCreate(t *testing.T) {
+	data := []byte("only written once a piece arrives")
+	torrent := checkTorrent(data, 16)
+
+	root := t.TempDir()
+	storage := NewFileStorage(torrent, root, ".part")
+	defer storage.Close()
+
+	piece := make([]byte, 16)
+	if err := storage.ReadAt(0, 0, piece); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("reading a missing file got error %v, want it not to exist", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "check.part")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("reading created the file")
+	}
+
+	// A file that has been read is reopened for writing.
+	if err := os.WriteFile(filepath.Join(root, "check.part"), make([]byte, len(data)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.ReadAt(0, 0, piece); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.WriteAt(0, 0, data[:16]); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.ReadAt(0, 0, piece); err != nil || !bytes.Equal(piece, data[:16]) {
+		t.Errorf("read %q, %v", piece, err)
+	}
+}
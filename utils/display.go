@@ -2,8 +2,6 @@ package utils
 
 import (
 	"fmt"
-	"os"
-	"os/signal"
 	"strings"
 	"time"
 )
@@ -24,7 +22,7 @@ func FlagUnicode(countryCode string) string {
 	flagUnicode := ""
 	for _, letter := range countryCode {
 		unicode := unicodeStart + (int(rune(letter)) - runeStart)
-		flagUnicode += string(unicode)
+		flagUnicode += string(rune(unicode))
 	}
 
 	return flagUnicode
@@ -34,15 +32,6 @@ func StartDisplay(download *Download, timeout time.Duration) Display {
 	display := Display{Download: download, Quit: make(chan struct{})}
 	ticker := time.NewTicker(timeout)
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
-
-	go func() {
-		<-signalChan
-		AnsiCleanUp()
-		os.Exit(1)
-	}()
-
 	fmt.Printf("\033[?25l")
 
 	go func() {
@@ -68,7 +57,8 @@ func (display Display) Print() {
 		fmt.Print(strings.Join(FlushLogs(), "\n"))
 	}
 
-	fmt.Printf("\n%s %s\n\033[F\033[F", ProgressBar(display.Download), Countries(display.Download))
+	status := display.Download.Status()
+	fmt.Printf("\n%s %s%s%s%s%s%s%s\n\033[F\033[F", ProgressBar(status), Swarm(status), Countries(status), Bans(status), FailedFiles(status), Moving(status), Hashing(status), Cache(status))
 }
 
 func (display Display) Close() {
@@ -78,18 +68,80 @@ func (display Display) Close() {
 	close(display.Quit)
 }
 
-func Countries(download *Download) string {
+func Countries(status Status) string {
 	emojis := make([]string, 0)
 
-	for _, country := range download.ConnectedCountries {
+	for _, country := range status.ConnectedCountries {
 		emojis = append(emojis, FlagUnicode(country))
 	}
 
 	return strings.Join(emojis, "  ")
 }
 
-func ProgressBar(download *Download) string {
-	percentComplete := float64(len(download.CompletedPieceHash)) / float64(len(download.Torrent.PieceHash))
+func Swarm(status Status) string {
+	if status.Swarm == (ScrapeResult{}) {
+		return ""
+	}
+
+	return fmt.Sprintf("%d seeders %d leechers  ", status.Swarm.Seeders, status.Swarm.Leechers)
+}
+
+func Bans(status Status) string {
+	if len(status.BannedPeers) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("  (%d banned)", len(status.BannedPeers))
+}
+
+func FailedFiles(status Status) string {
+	if len(status.FailedFiles) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("  (%d files failed their sha1 check)", len(status.FailedFiles))
+}
+
+func Moving(status Status) string {
+	if !status.Moving {
+		return ""
+	}
+
+	if status.MoveSize == 0 {
+		return "  (moving)"
+	}
+
+	return fmt.Sprintf("  (moving %.0f%%)", float64(status.Moved)/float64(status.MoveSize)*100)
+}
+
+func Hashing(status Status) string {
+	if status.Hashing.Queued == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("  (%d hashing)", status.Hashing.Queued)
+}
+
+func Cache(status Status) string {
+	cache := make([]string, 0)
+
+	if status.Cache.ReadHits+status.Cache.ReadMisses > 0 {
+		cache = append(cache, fmt.Sprintf("%.0f%% cache hits", status.Cache.HitRate()*100))
+	}
+
+	if status.Cache.Flushes > 0 {
+		cache = append(cache, fmt.Sprintf("last flush %s", status.Cache.LastFlushTime.Round(time.Millisecond)))
+	}
+
+	if len(cache) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("  (%s)", strings.Join(cache, ", "))
+}
+
+func ProgressBar(status Status) string {
+	percentComplete := float64(status.CompletedPieces) / float64(status.TotalPieces)
 
 	progressBarSize := 50
 	numCompletedBlocks := int(percentComplete * float64(progressBarSize))
@@ -1,158 +1,459 @@
 package utils
 
 import (
-	"crypto/sha1"
-	"os"
-	"strings"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Download struct {
 	ConnectedCountries []string
 	Torrent            TorrentFile
-	CompletedPieceHash [][20]byte
+	CompletedPieces    int
+	Have               Bitfield
 	PieceIndexChan     chan int
-	Completed          chan bool
+	Completed          chan struct{}
+	Bans               *BanList
+	Filter             *IPFilter
+	Uploaded           int64
+	Downloaded         int64
+	Swarm              ScrapeResult
+	Storage            Storage
+	Hashes             *HashPool
+	UTP                *UTPSocket
+	UseUTP             bool
+	Port               uint16
+	Extensions         *Extensions
+	Choker             *Choker
+	SuperSeed          *SuperSeeder
+	peers              map[*Peer]struct{}
+	knownPeers         map[string]bool
+	SavePath           string
+	FailedFiles        []string
+	lock               sync.Mutex
+	completeOnce       sync.Once
+
+	// moving is set while the completed download is moved to SavePath, with
+	// moved of moveSize bytes done.
+	moving   bool
+	moved    int64
+	moveSize int64
+
+	// finishing counts finishFiles calls still running, which must be done
+	// before the download is moved.
+	finishing sync.WaitGroup
+
+	// utpPeers holds the addresses of peers that reached us over uTP, the only
+	// ones we dial over uTP in turn.
+	utpPeers map[string]bool
+
+	// quit is closed when the download is closed, to stop everything sending
+	// to or waiting on PieceIndexChan.
+	quit chan struct{}
 }
 
-func StartDownload(torrent TorrentFile) (*Download, error) {
+// DownloadOptions are the settings StartDownload needs before any data moves.
+type DownloadOptions struct {
+	// SavePath is where the data is moved once complete, if it is stored
+	// elsewhere while in progress.
+	SavePath string
+
+	// Preallocate is how disk space is reserved up front: none, sparse or full.
+	Preallocate string
+}
+
+// StartDownload sets up storage and queues the pieces we don't have yet. Data
+// is moved to the save path once complete, which may be straight away when all
+// of it is already on disk.
+func StartDownload(torrent TorrentFile, storage Storage, options DownloadOptions) (*Download, error) {
 	download := &Download{
 		Torrent:            torrent,
+		Storage:            storage,
+		SavePath:           options.SavePath,
 		PieceIndexChan:     make(chan int, 50),
 		ConnectedCountries: make([]string, 0),
-		Completed:          make(chan bool, 1),
+		Completed:          make(chan struct{}),
+		Bans:               NewBanList(),
+		Have:               CreateBitfield(torrent.NumPieces()),
+		Hashes:             NewHashPool(runtime.NumCPU(), torrent.VerifyPiece),
+		Extensions:         NewExtensions(len(torrent.Info)),
+		peers:              make(map[*Peer]struct{}),
+		knownPeers:         make(map[string]bool),
+		utpPeers:           make(map[string]bool),
+		quit:               make(chan struct{}),
+	}
+
+	err := download.CheckFreeSpace()
+	if err != nil {
+		return nil, err
+	}
+
+	err = download.Preallocate(options.Preallocate)
+	if err != nil {
+		return nil, err
+	}
+
+	err = download.PrepareFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	err = download.CheckExisting()
+	if err != nil {
+		return nil, err
+	}
+
+	if download.Complete() {
+		download.complete()
 	}
 
 	go func() {
-		for i := 0; i < len(torrent.PieceHash); i++ {
-			download.PieceIndexChan <- i
+		for i := 0; i < torrent.NumPieces(); i++ {
+			if !download.HasPiece(i) && !download.queue(i) {
+				return
+			}
 		}
 	}()
 
 	return download, nil
 }
 
+func (download *Download) Allowed(peer Peer) bool {
+	if download.Bans.IsBanned(peer.IP) {
+		Debugf("Skipping banned peer: %s", peer.IP.String())
+		return false
+	}
+
+	if download.Filter.Blocked(peer.IP) {
+		Debugf("Skipping blocklisted peer: %s", peer.IP.String())
+		return false
+	}
+
+	return true
+}
+
+// AddPeers connects to peers found by trackers or local discovery, skipping
+// any we have already tried.
+func (download *Download) AddPeers(peers []Peer) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	for _, peer := range peers {
+		address := peer.Address()
+		if download.knownPeers[address] {
+			continue
+		}
+		download.knownPeers[address] = true
+
+		go download.AddPeer(peer)
+	}
+}
+
 func (download *Download) AddPeer(peer Peer) {
+	if !download.Allowed(peer) {
+		return
+	}
+
+	if download.Torrent.Private && peer.Source != SourceTracker {
+		Debugf("Skipping %s found outside the trackers of a private torrent", peer)
+		return
+	}
+
+	download.lock.Lock()
+	if download.utpPeers[peer.Address()] {
+		peer.UTP = download.UTP
+	}
+	download.lock.Unlock()
+
 	err := peer.Handshake(download.Torrent)
 	if err != nil {
 		Debugf("Handshake failed: %s", peer.IP.String())
 		return
 	}
 
-	err = peer.AnnounceInterested(download.Torrent)
+	download.requestPieces(peer)
+}
+
+func (download *Download) requestPieces(peer Peer) {
+	peer.Extensions = download.Extensions
+
+	download.lock.Lock()
+	have := append(Bitfield(nil), download.Have...)
+	interested := download.CompletedPieces < download.Torrent.NumPieces()
+	download.lock.Unlock()
+
+	superSeeding := download.SuperSeed.Active()
+	if superSeeding {
+		have = CreateBitfield(download.Torrent.NumPieces())
+	}
+
+	err := peer.AnnounceInterested(download.Torrent, have, interested)
 	if err != nil {
 		Debugf("Failed to initiate download: %s", peer.IP.String())
+		peer.Connection.Close()
 		return
 	}
 
-	download.ConnectedCountries = append(download.ConnectedCountries, GetCountryCode(peer))
+	countryCode := GetCountryCode(peer)
+	download.lock.Lock()
+	download.ConnectedCountries = append(download.ConnectedCountries, countryCode)
+	download.lock.Unlock()
+
+	download.register(&peer)
+	go download.readLoop(&peer)
+
+	if superSeeding {
+		download.SuperSeed.offer(&peer)
+	}
+
+	download.fetchPieces(&peer)
+}
+
+// pieceSource is anything we can download verified pieces from: a peer or a
+// web seed.
+type pieceSource interface {
+	HasPiece(index int) bool
+	GetPiece(index int, torrent TorrentFile) ([]byte, error)
+	String() string
+}
+
+func (download *Download) fetchPieces(source pieceSource) {
+	// Counted by hash workers, so accessed atomically.
+	var failures int32
+
+	// Failed requests in a row, which web seeds back off from.
+	requestErrors := 0
 
 	for {
-		pieceIndex, more := <-download.PieceIndexChan
-		if !more {
+		// Web seeds can't be banned by IP, so stop using them instead.
+		if peer, ok := source.(*Peer); ok && (download.Bans.IsBanned(peer.IP) || peer.Closed()) {
+			peer.Close()
+			return
+		} else if !ok && atomic.LoadInt32(&failures) >= maxStrikes {
+			Debugf("Giving up on %s after %d invalid pieces", source, atomic.LoadInt32(&failures))
 			return
 		}
 
-		if !peer.Bitfield.HasPiece(pieceIndex) {
-			download.PieceIndexChan <- pieceIndex
+		var pieceIndex int
+		select {
+		case pieceIndex = <-download.PieceIndexChan:
+		case <-download.quit:
+			return
+		}
+
+		if !source.HasPiece(pieceIndex) {
+			download.queue(pieceIndex)
 			continue
 		}
 
-		Debugf("Requesting piece with index %d from peer with IP %s", pieceIndex, peer.IP.String())
+		Debugf("Requesting piece with index %d from %s", pieceIndex, source)
 
-		piece, err := peer.GetPiece(pieceIndex, download.Torrent)
+		piece, err := source.GetPiece(pieceIndex, download.Torrent)
 		if err != nil {
 			Debugf("Error requesting piece: %s", err)
 
-			download.PieceIndexChan <- pieceIndex
-			continue
-		}
+			download.queue(pieceIndex)
 
-		pieceHash := sha1.Sum(piece)
-		if download.Torrent.PieceHash[pieceIndex] != pieceHash {
-			Debugf("Invalid piece from IP %s with index %d", peer.IP.String(), pieceIndex)
+			if seed, ok := source.(*WebSeed); ok {
+				requestErrors += 1
+				if requestErrors >= maxWebSeedErrors {
+					Debugf("Giving up on %s after %d failed requests", source, requestErrors)
+					return
+				}
 
-			download.PieceIndexChan <- pieceIndex
+				seed.backOff(webSeedRetry << (requestErrors - 1))
+
+				select {
+				case <-time.After(time.Until(seed.unavailableUntil)):
+				case <-download.quit:
+					return
+				}
+			}
 			continue
 		}
+		requestErrors = 0
 
-		err = download.WriteAt(pieceIndex*download.Torrent.PieceLength, piece)
-		if err != nil {
-			Debugf("Error writing piece from IP %s with index %d: %s", peer.IP.String(), pieceIndex, err)
-
-			download.PieceIndexChan <- pieceIndex
-			continue
+		contributors := make([]net.IP, 0)
+		if peer, ok := source.(*Peer); ok {
+			contributors = append(contributors, peer.IP)
 		}
 
-		download.CompletedPieceHash = append(download.CompletedPieceHash, pieceHash)
+		err = download.Hashes.Submit(pieceIndex, piece, func(valid bool) {
+			if !valid {
+				Debugf("Invalid piece from %s with index %d", source, pieceIndex)
+
+				atomic.AddInt32(&failures, 1)
+				download.requeue(pieceIndex)
+				download.reportBans(download.Bans.RecordFailure(pieceIndex, contributors))
+				return
+			}
 
-		if len(download.CompletedPieceHash) == len(download.Torrent.PieceHash) {
-			download.Completed <- true
+			download.storePiece(pieceIndex, piece, source, contributors)
+		})
+		if err != nil {
+			return
 		}
 	}
 }
 
-func (download Download) Close() {
-	close(download.PieceIndexChan)
+// requeue puts a piece back to be downloaded again. Hash workers call it, and
+// must not wait on a full queue that only peers blocked on them would drain.
+func (download *Download) requeue(pieceIndex int) {
+	go download.queue(pieceIndex)
+}
+
+// queue puts a piece on PieceIndexChan, unless the download is closed first.
+func (download *Download) queue(pieceIndex int) bool {
+	select {
+	case download.PieceIndexChan <- pieceIndex:
+		return true
+	case <-download.quit:
+		return false
+	}
 }
 
-func WriteAtFile(path []string, offset int, fileBytes []byte) error {
-	fileDir := strings.Join(path[:len(path)-1], "/")
-	filePath := strings.Join(path, "/")
+// storePiece writes a verified piece and records it as completed.
+func (download *Download) storePiece(pieceIndex int, piece []byte, source pieceSource, contributors []net.IP) {
+	err := download.Storage.WriteAt(pieceIndex, 0, piece)
+	if err != nil {
+		Debugf("Error writing piece from %s with index %d: %s", source, pieceIndex, err)
 
-	if len(fileDir) > 0 {
-		err := os.MkdirAll(fileDir, os.ModePerm)
-		if err != nil {
-			return err
-		}
+		download.requeue(pieceIndex)
+		return
 	}
 
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	download.reportBans(download.Bans.RecordSuccess(pieceIndex, contributors))
+
+	download.lock.Lock()
+	download.CompletedPieces += 1
+	download.Have.SetPiece(pieceIndex)
+	download.Downloaded += int64(len(piece))
+	completed := download.CompletedPieces == download.Torrent.NumPieces()
+	download.finishing.Add(1)
+	download.lock.Unlock()
+
+	go func() {
+		defer download.finishing.Done()
+		download.finishFiles(pieceIndex)
+	}()
+
+	go download.broadcast(Message{ID: MsgHave, Payload: appendUint32(nil, uint32(pieceIndex))})
+
+	if completed {
+		download.complete()
+	}
+}
+
+func (download *Download) complete() {
+	download.completeOnce.Do(func() {
+		// Moving the files can take a while, so it doesn't hold up the hash
+		// worker that verified the last piece.
+		go func() {
+			download.finish()
+			close(download.Completed)
+
+			download.broadcast(Message{ID: MsgUninterested})
+		}()
+	})
+}
+
+// finish flushes a completed download and moves it to the save path if it was
+// stored elsewhere while in progress.
+func (download *Download) finish() {
+	download.finishing.Wait()
+
+	err := download.Storage.Flush()
 	if err != nil {
-		return err
+		Debugf("Error flushing storage: %s", err)
+	}
+
+	disk, ok := asDiskStorage(download.Storage)
+	if !ok || len(download.SavePath) == 0 {
+		return
 	}
-	defer file.Close()
 
-	_, err = file.WriteAt(fileBytes, int64(offset))
+	download.lock.Lock()
+	download.moving = true
+	download.lock.Unlock()
+
+	err = disk.Move(download.SavePath, func(moved int64, total int64) {
+		download.lock.Lock()
+		download.moved, download.moveSize = moved, total
+		download.lock.Unlock()
+	})
 	if err != nil {
-		return err
+		Debugf("Error moving download to %s: %s", download.SavePath, err)
 	}
 
-	return nil
+	download.lock.Lock()
+	download.moving = false
+	download.lock.Unlock()
 }
 
-func (download Download) WriteAt(offset int, piece []byte) error {
-	if len(download.Torrent.Files) == 0 {
-		err := WriteAtFile([]string{"downloads", download.Torrent.Name}, offset, piece)
-		return err
-	}
+func (download *Download) Complete() bool {
+	download.lock.Lock()
+	defer download.lock.Unlock()
 
-	fileOffset := 0
+	return download.CompletedPieces == download.Torrent.NumPieces()
+}
 
-	for _, file := range download.Torrent.Files {
-		filePath := append([]string{"downloads", download.Torrent.Name}, file.Path...)
-		fileMin := fileOffset
-		fileMax := fileMin + file.Length
+func (download *Download) SetSwarm(swarm ScrapeResult) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
 
-		pieceBeginsInFile := fileMin <= offset && offset < fileMax
-		pieceEndsInFile := fileMin <= (offset+len(piece)) && (offset+len(piece)) < fileMax
+	download.Swarm = swarm
+}
 
-		if pieceBeginsInFile && pieceEndsInFile {
-			err := WriteAtFile(filePath, offset-fileMin, piece)
-			return err
-		}
+// SetPeerCounts updates the swarm size from an announce response, which unlike
+// a scrape doesn't include the number of completed downloads.
+func (download *Download) SetPeerCounts(seeders int, leechers int) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
 
-		if pieceBeginsInFile {
-			pieceLength := fileMax - offset
-			err := WriteAtFile(filePath, offset-fileMin, piece[:pieceLength])
-			if err != nil {
-				return err
-			}
+	download.Swarm.Seeders = seeders
+	download.Swarm.Leechers = leechers
+}
 
-			return download.WriteAt(offset+pieceLength, piece[pieceLength:])
+// Counters returns the uploaded, downloaded and remaining byte counts reported
+// to trackers.
+func (download *Download) Counters() (uploaded int64, downloaded int64, left int64) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	left = int64(download.Torrent.Length)
+	for i := 0; i < download.Torrent.NumPieces(); i++ {
+		if download.Have.HasPiece(i) {
+			left -= int64(download.Torrent.PieceSize(i))
 		}
+	}
+
+	return download.Uploaded, download.Downloaded, left
+}
 
-		fileOffset += file.Length
+func (download *Download) reportBans(banned []string) {
+	for _, ip := range banned {
+		Debugf("Banned peer with IP %s for sending corrupt pieces", ip)
 	}
+}
+
+func (download *Download) Close() {
+	close(download.quit)
+	download.Hashes.Close()
 
-	return nil
+	if download.Choker != nil {
+		download.Choker.Stop()
+	}
+
+	if download.UTP != nil {
+		download.UTP.Close()
+	}
+
+	download.finishing.Wait()
+
+	err := download.Storage.Close()
+	if err != nil {
+		Debugf("Error closing storage: %s", err)
+	}
 }
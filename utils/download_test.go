@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// checkTorrent describes data split into pieces of the given length.
+func checkTorrent(data []byte, pieceLength int) TorrentFile {
+	torrent := TorrentFile{Name: "check", PieceLength: pieceLength, Length: len(data)}
+	for offset := 0; offset < len(data); offset += pieceLength {
+		end := offset + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		torrent.PieceHash = append(torrent.PieceHash, sha1.Sum(data[offset:end]))
+	}
+
+	return torrent
+}
+
+type failingSource struct{}
+
+func (failingSource) HasPiece(index int) bool { return true }
+
+func (failingSource) GetPiece(index int, torrent TorrentFile) ([]byte, error) {
+	return nil, errors.New("no data")
+}
+
+func (failingSource) String() string { return "failing source" }
+
+func TestDownloadCloseWhileQueueing(t *testing.T) {
+	// More pieces than PieceIndexChan holds, so queueing them is still blocked
+	// when the download closes.
+	torrent := TorrentFile{PieceLength: 16, Length: 16 * 100, PieceHash: make([][20]byte, 100)}
+
+	download, err := StartDownload(torrent, NewMemoryStorage(torrent), DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	download.Close()
+
+	done := make(chan struct{})
+	go func() {
+		download.fetchPieces(failingSource{})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetching pieces didn't stop when the download closed")
+	}
+
+	// Sending on a closed PieceIndexChan would have panicked by now.
+	download.requeue(0)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestPrivateTorrentSkipsLocalPeers(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan struct{}, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	download := &Download{Torrent: TorrentFile{Private: true}, Bans: NewBanList()}
+	peer := Peer{IP: net.IPv4(127, 0, 0, 1), Port: uint16(listener.Addr().(*net.TCPAddr).Port)}
+
+	local := peer
+	local.Source = SourceLSD
+	download.AddPeer(local)
+
+	select {
+	case <-accepted:
+		t.Fatal("connected to a peer found by local discovery for a private torrent")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Peers from the trackers are still dialled.
+	download.AddPeer(peer)
+
+	select {
+	case <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("didn't connect to a peer from the trackers")
+	}
+}
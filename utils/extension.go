@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// The extension protocol (BEP 10) carries extensions such as ut_metadata and
+// ut_pex under a single message ID. Each side sends a handshake mapping the
+// names of the extensions it supports to the IDs it wants them sent with.
+const (
+	MsgExtended messageID = 20
+
+	extendedHandshake    = 0
+	extendedRequestQueue = 250
+	clientVersion        = "go-torrent"
+)
+
+// Extension is a protocol built on the extension protocol. It is identified by
+// Name in handshakes, and gets the payload of messages sent to it without the
+// extended message ID.
+type Extension interface {
+	Name() string
+
+	// Handshake is called whenever a peer sends its extension handshake, which
+	// is then in peer.ExtensionHandshake.
+	Handshake(peer *Peer) error
+	HandleMessage(peer *Peer, payload []byte) error
+}
+
+type ExtensionHandshake struct {
+	M            map[string]int `bencode:"m"`
+	Version      string         `bencode:"v,omitempty"`
+	YourIP       string         `bencode:"yourip,omitempty"`
+	IPv6         string         `bencode:"ipv6,omitempty"`
+	Port         int            `bencode:"p,omitempty"`
+	RequestQueue int            `bencode:"reqq,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// Extensions are the extensions a download supports. They are numbered in the
+// order they were registered, starting at 1.
+type Extensions struct {
+	// Port is where we accept connections, to tell peers that connected to us
+	// from a different one.
+	Port         int
+	MetadataSize int
+	extensions   []Extension
+	lock         sync.RWMutex
+}
+
+func NewExtensions(metadataSize int) *Extensions {
+	return &Extensions{MetadataSize: metadataSize}
+}
+
+// Register adds an extension to the handshakes of peers that connect from now
+// on.
+func (extensions *Extensions) Register(extension Extension) {
+	extensions.lock.Lock()
+	defer extensions.lock.Unlock()
+
+	extensions.extensions = append(extensions.extensions, extension)
+}
+
+func (extensions *Extensions) Get(id int) Extension {
+	if extensions == nil {
+		return nil
+	}
+
+	extensions.lock.RLock()
+	defer extensions.lock.RUnlock()
+
+	if id < 1 || id > len(extensions.extensions) {
+		return nil
+	}
+
+	return extensions.extensions[id-1]
+}
+
+func (extensions *Extensions) All() []Extension {
+	if extensions == nil {
+		return nil
+	}
+
+	extensions.lock.RLock()
+	defer extensions.lock.RUnlock()
+
+	return append([]Extension(nil), extensions.extensions...)
+}
+
+// Handshake is the extension handshake we send to peer.
+func (extensions *Extensions) Handshake(peer *Peer) ExtensionHandshake {
+	handshake := ExtensionHandshake{
+		M:            make(map[string]int),
+		Version:      clientVersion,
+		RequestQueue: extendedRequestQueue,
+	}
+
+	for i, extension := range extensions.All() {
+		handshake.M[extension.Name()] = i + 1
+	}
+
+	if ip := peer.IP.To4(); ip != nil {
+		handshake.YourIP = string(ip)
+	} else {
+		handshake.YourIP = string(peer.IP.To16())
+	}
+
+	// Tell peers reached over IPv4 how to reach us over IPv6 as well.
+	if ip := publicIPv6(); ip != nil {
+		handshake.IPv6 = string(ip.To16())
+	}
+
+	if extensions != nil {
+		handshake.Port = extensions.Port
+		handshake.MetadataSize = extensions.MetadataSize
+	}
+
+	return handshake
+}
+
+func (peer *Peer) SendExtensionHandshake() error {
+	var buffer bytes.Buffer
+	buffer.WriteByte(extendedHandshake)
+
+	err := bencode.Marshal(&buffer, peer.Extensions.Handshake(peer))
+	if err != nil {
+		return err
+	}
+
+	return peer.SendMessage(Message{ID: MsgExtended, Payload: buffer.Bytes()})
+}
+
+// SendExtended sends a message for the named extension, if the peer supports
+// it.
+func (peer *Peer) SendExtended(name string, payload []byte) error {
+	peer.session.lock.Lock()
+	id := peer.ExtensionHandshake.M[name]
+	peer.session.lock.Unlock()
+
+	if id <= 0 || id > 255 {
+		return fmt.Errorf("%s doesn't support %s", peer, name)
+	}
+
+	message := Message{ID: MsgExtended, Payload: append([]byte{byte(id)}, payload...)}
+
+	return peer.SendMessage(message)
+}
+
+// SupportsExtension reports whether the peer's handshake lists the extension.
+func (peer *Peer) SupportsExtension(name string) bool {
+	peer.session.lock.Lock()
+	defer peer.session.lock.Unlock()
+
+	return peer.ExtensionHandshake.M[name] > 0
+}
+
+func (peer *Peer) handleExtended(payload []byte) error {
+	if !peer.Extended {
+		return errors.New("extended message from a peer without the extension protocol")
+	}
+
+	if len(payload) == 0 {
+		return errors.New("empty extended message")
+	}
+
+	if payload[0] != extendedHandshake {
+		extension := peer.Extensions.Get(int(payload[0]))
+		if extension == nil {
+			Debugf("Ignoring message for unknown extension %d from %s", payload[0], peer)
+			return nil
+		}
+
+		return extension.HandleMessage(peer, payload[1:])
+	}
+
+	handshake := ExtensionHandshake{}
+	err := bencode.Unmarshal(bytes.NewReader(payload[1:]), &handshake)
+	if err != nil {
+		return err
+	}
+
+	peer.updateExtensionHandshake(handshake)
+
+	if len(handshake.YourIP) == net.IPv4len || len(handshake.YourIP) == net.IPv6len {
+		Debugf("%s sees us as %s", peer, net.IP(handshake.YourIP))
+	}
+
+	for _, extension := range peer.Extensions.All() {
+		err := extension.Handshake(peer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateExtensionHandshake applies a handshake on top of earlier ones, which a
+// peer may send to enable extensions, or disable them with an ID of 0.
+func (peer *Peer) updateExtensionHandshake(handshake ExtensionHandshake) {
+	peer.session.lock.Lock()
+	defer peer.session.lock.Unlock()
+
+	current := &peer.ExtensionHandshake
+	if current.M == nil {
+		current.M = make(map[string]int)
+	}
+
+	for name, id := range handshake.M {
+		if id > 0 {
+			current.M[name] = id
+		} else {
+			delete(current.M, name)
+		}
+	}
+
+	if len(handshake.Version) > 0 {
+		current.Version = handshake.Version
+	}
+	if len(handshake.YourIP) > 0 {
+		current.YourIP = handshake.YourIP
+	}
+	if len(handshake.IPv6) > 0 {
+		current.IPv6 = handshake.IPv6
+	}
+	if handshake.Port > 0 {
+		current.Port = handshake.Port
+	}
+	if handshake.RequestQueue > 0 {
+		current.RequestQueue = handshake.RequestQueue
+	}
+	if handshake.MetadataSize > 0 {
+		current.MetadataSize = handshake.MetadataSize
+	}
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testExtension records the handshakes and messages it is given.
+type testExtension struct {
+	name       string
+	handshakes int
+	messages   []string
+	lock       sync.Mutex
+}
+
+func (extension *testExtension) Name() string {
+	return extension.name
+}
+
+func (extension *testExtension) Handshake(peer *Peer) error {
+	extension.lock.Lock()
+	defer extension.lock.Unlock()
+
+	extension.handshakes += 1
+	return nil
+}
+
+func (extension *testExtension) HandleMessage(peer *Peer, payload []byte) error {
+	extension.lock.Lock()
+	defer extension.lock.Unlock()
+
+	extension.messages = append(extension.messages, string(payload))
+	return nil
+}
+
+// testExtendedPeers connects two peers supporting the extension protocol over
+// a pipe, returning the local side's view of the remote peer and the remote
+// side's view of us.
+func testExtendedPeers(t *testing.T, local *Extensions, remote *Extensions) (*Peer, *Peer) {
+	localConn, remoteConn := net.Pipe()
+	t.Cleanup(func() {
+		localConn.Close()
+		remoteConn.Close()
+	})
+
+	torrent := TorrentFile{PieceLength: 16384}
+	toRemote := &Peer{IP: net.IPv4(192, 0, 2, 2), Connection: localConn, Extended: true, Extensions: local, session: newPeerSession(torrent)}
+	toLocal := &Peer{IP: net.IPv4(192, 0, 2, 1), Connection: remoteConn, Extended: true, Extensions: remote, session: newPeerSession(torrent)}
+
+	return toRemote, toLocal
+}
+
+// testSend sends from one peer and has the other read and handle the message.
+func testSend(t *testing.T, send func() error, receiver *Peer) Message {
+	errs := make(chan error, 1)
+	go func() { errs <- send() }()
+
+	message, err := receiver.readMessage(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	return message
+}
+
+func TestExtensionHandshake(t *testing.T) {
+	ours := &testExtension{name: "ut_test"}
+	local := NewExtensions(1234)
+	local.Port = 6881
+	local.Register(ours)
+
+	// The remote peer numbers the same extension differently.
+	theirs := &testExtension{name: "ut_test"}
+	remote := NewExtensions(0)
+	remote.Register(&testExtension{name: "ut_other"})
+	remote.Register(theirs)
+
+	toRemote, toLocal := testExtendedPeers(t, local, remote)
+	testSend(t, toRemote.SendExtensionHandshake, toLocal)
+	testSend(t, toLocal.SendExtensionHandshake, toRemote)
+
+	handshake := toLocal.ExtensionHandshake
+	if handshake.M["ut_test"] != 1 || handshake.Version != clientVersion || handshake.Port != 6881 || handshake.MetadataSize != 1234 || handshake.RequestQueue != extendedRequestQueue {
+		t.Errorf("remote peer got handshake %+v", handshake)
+	}
+	if !net.IP(handshake.YourIP).Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Errorf("remote peer was told its IP is %s, want 192.0.2.2", net.IP(handshake.YourIP))
+	}
+	if ours.handshakes != 1 || theirs.handshakes != 1 {
+		t.Errorf("extensions saw %d and %d handshakes, want 1 each", ours.handshakes, theirs.handshakes)
+	}
+
+	// Messages are sent with the ID the receiver chose.
+	testSend(t, func() error { return toRemote.SendExtended("ut_test", []byte("to remote")) }, toLocal)
+	testSend(t, func() error { return toLocal.SendExtended("ut_test", []byte("to local")) }, toRemote)
+	if len(theirs.messages) != 1 || theirs.messages[0] != "to remote" || len(ours.messages) != 1 || ours.messages[0] != "to local" {
+		t.Errorf("extensions got %q and %q", theirs.messages, ours.messages)
+	}
+
+	if err := toRemote.SendExtended("ut_missing", nil); err == nil {
+		t.Error("sent a message for an extension the peer doesn't support")
+	}
+
+	// Messages for unknown extensions are ignored.
+	testSend(t, func() error { return toRemote.SendMessage(Message{ID: MsgExtended, Payload: []byte{9, 'x'}}) }, toLocal)
+}
+
+func TestExtensionHandshakeUpdate(t *testing.T) {
+	peer := &Peer{session: newPeerSession(TorrentFile{PieceLength: 16384})}
+
+	peer.updateExtensionHandshake(ExtensionHandshake{M: map[string]int{"ut_pex": 1, "ut_metadata": 2}, Version: "other", MetadataSize: 100})
+	peer.updateExtensionHandshake(ExtensionHandshake{M: map[string]int{"ut_pex": 0, "ut_holepunch": 3}})
+
+	handshake := peer.ExtensionHandshake
+	if peer.SupportsExtension("ut_pex") || !peer.SupportsExtension("ut_metadata") || !peer.SupportsExtension("ut_holepunch") {
+		t.Errorf("extensions after update %v", handshake.M)
+	}
+	if handshake.Version != "other" || handshake.MetadataSize != 100 {
+		t.Errorf("later handshake cleared fields it didn't set: %+v", handshake)
+	}
+}
+
+func TestExtendedFromPeerWithoutExtensions(t *testing.T) {
+	peer := &Peer{session: newPeerSession(TorrentFile{PieceLength: 16384})}
+
+	if err := peer.handleExtended([]byte{extendedHandshake, 'd', 'e'}); err == nil {
+		t.Error("accepted an extended message from a peer without the extension protocol")
+	}
+}
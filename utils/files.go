@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PrepareFiles creates the files of a multi-file torrent that carry no data,
+// and so would never be written by a piece: empty files and BEP 47 symlinks.
+func (download *Download) PrepareFiles() error {
+	disk, ok := asDiskStorage(download.Storage)
+	if !ok {
+		return nil
+	}
+	name := download.Torrent.Name
+
+	for _, file := range download.Torrent.Files {
+		if file.Padding {
+			continue
+		}
+
+		if !file.Symlink {
+			if file.Length == 0 {
+				err := createEmptyFile(disk.FilePath(append([]string{name}, file.Path...)))
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// Targets are relative to the link and use final file names, so links stay
+		// valid once an incomplete download is moved.
+		root := storagePath("", []string{name}, "")
+		linkPath := storagePath(root, file.Path, "")
+		targetPath := storagePath(root, file.SymlinkPath, "")
+
+		// Links may only point at other files in the torrent.
+		if len(file.SymlinkPath) == 0 || !strings.HasPrefix(targetPath, root+string(filepath.Separator)) {
+			return errors.New("symlink target escapes the torrent: " + strings.Join(file.Path, "/"))
+		}
+
+		target, err := filepath.Rel(filepath.Dir(linkPath), targetPath)
+		if err != nil {
+			return err
+		}
+
+		linkPath = disk.FilePath(append([]string{name}, file.Path...))
+
+		err = os.MkdirAll(filepath.Dir(linkPath), os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		// A link left over from an earlier version of the torrent is replaced, but
+		// anything else in its place is left alone.
+		if existing, err := os.Readlink(linkPath); err == nil && existing == target {
+			continue
+		} else if err == nil {
+			err = os.Remove(linkPath)
+			if err != nil {
+				return err
+			}
+		} else if _, err := os.Lstat(linkPath); err == nil {
+			Debugf("Not replacing %s with a symlink, as something else is there", linkPath)
+			continue
+		}
+
+		err = os.Symlink(target, linkPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createEmptyFile(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// finishFiles applies file attributes and checks per-file hashes for any file
+// the given piece was the last missing piece of. It reads whole files back, so
+// it runs on its own goroutine rather than holding up a hash worker.
+func (download *Download) finishFiles(pieceIndex int) {
+	torrent := download.Torrent
+
+	for _, fileRange := range torrent.FileRanges(pieceIndex*torrent.PieceLength, torrent.PieceLength) {
+		if fileRange.Padding || fileRange.FileIndex < 0 || !download.hasFile(fileRange.FileIndex) {
+			continue
+		}
+
+		file := torrent.Files[fileRange.FileIndex]
+
+		if file.SHA1 != nil {
+			err := download.verifyFileSHA1(fileRange.FileIndex, file.SHA1)
+			if err != nil {
+				Debugf("File %s failed its sha1 check: %s", strings.Join(file.Path, "/"), err)
+
+				download.lock.Lock()
+				download.FailedFiles = append(download.FailedFiles, strings.Join(file.Path, "/"))
+				download.lock.Unlock()
+			}
+		}
+
+		disk, ok := asDiskStorage(download.Storage)
+		if !ok {
+			continue
+		}
+		filePath := disk.FilePath(fileRange.Path)
+
+		// The file may still be sitting in the write cache.
+		if file.Executable || file.Hidden {
+			if err := download.Storage.Flush(); err != nil {
+				Debugf("Error flushing %s: %s", filePath, err)
+			}
+		}
+
+		if file.Executable {
+			if err := makeExecutable(filePath); err != nil {
+				Debugf("Error marking %s executable: %s", filePath, err)
+			}
+		}
+
+		if file.Hidden {
+			if err := setHidden(filePath); err != nil {
+				Debugf("Error hiding %s: %s", filePath, err)
+			}
+		}
+	}
+}
+
+// makeExecutable lets whoever can read the file execute it too, keeping the
+// permissions the umask gave it.
+func makeExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	mode := info.Mode().Perm()
+	return os.Chmod(path, mode|(mode&0444)>>2)
+}
+
+func (download *Download) fileStart(fileIndex int) int {
+	start := 0
+	for _, file := range download.Torrent.Files[:fileIndex] {
+		start += file.Length
+	}
+
+	return start
+}
+
+func (download *Download) hasFile(fileIndex int) bool {
+	torrent := download.Torrent
+
+	start := download.fileStart(fileIndex)
+	end := start + torrent.Files[fileIndex].Length
+
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	for index := start / torrent.PieceLength; index*torrent.PieceLength < end; index++ {
+		if !download.Have.HasPiece(index) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// verifyFileSHA1 reads a file back from storage a piece at a time and checks
+// it against its BEP 47 sha1.
+func (download *Download) verifyFileSHA1(fileIndex int, expected []byte) error {
+	torrent := download.Torrent
+	start := download.fileStart(fileIndex)
+	end := start + torrent.Files[fileIndex].Length
+
+	hash := sha1.New()
+	data := make([]byte, torrent.PieceLength)
+
+	for offset := start; offset < end; {
+		begin := offset % torrent.PieceLength
+		length := torrent.PieceLength - begin
+		if end-offset < length {
+			length = end - offset
+		}
+
+		err := download.Storage.ReadAt(offset/torrent.PieceLength, begin, data[:length])
+		if err != nil {
+			return err
+		}
+
+		hash.Write(data[:length])
+		offset += length
+	}
+
+	if !bytes.Equal(hash.Sum(nil), expected) {
+		return errors.New("hash mismatch")
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrepareFilesSymlinks(t *testing.T) {
+	torrent := TorrentFile{Name: "links", PieceLength: 16, Length: 16, PieceHash: make([][20]byte, 1), Files: []File{
+		{Length: 16, Path: []string{"a.txt"}},
+		{Path: []string{"stale"}, Symlink: true, SymlinkPath: []string{"a.txt"}},
+		{Path: []string{"occupied"}, Symlink: true, SymlinkPath: []string{"a.txt"}},
+	}}
+
+	root := t.TempDir()
+	storage := NewFileStorage(torrent, root, "")
+	defer storage.Close()
+
+	// A link from an earlier version of the torrent, and a file a link would
+	// replace.
+	dir := filepath.Join(root, "links")
+	os.MkdirAll(dir, os.ModePerm)
+	os.Symlink("elsewhere", filepath.Join(dir, "stale"))
+	os.WriteFile(filepath.Join(dir, "occupied"), []byte("keep me"), 0666)
+
+	download := &Download{Torrent: torrent, Storage: storage}
+	if err := download.PrepareFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	if target, err := os.Readlink(filepath.Join(dir, "stale")); err != nil || target != "a.txt" {
+		t.Errorf("stale link points at %q, %v", target, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "occupied")); err != nil || string(data) != "keep me" {
+		t.Errorf("replaced a file with a link: %q, %v", data, err)
+	}
+}
+
+func TestFinishFiles(t *testing.T) {
+	data := []byte("#!/bin/sh\necho hi\nsome other file")
+	good := sha1.Sum(data[18:])
+
+	torrent := checkTorrent(data, 16)
+	torrent.Name = "finish"
+	torrent.Files = []File{
+		{Length: 18, Path: []string{"run.sh"}, Executable: true, SHA1: make([]byte, 20)},
+		{Length: len(data) - 18, Path: []string{"other"}, SHA1: good[:]},
+	}
+
+	root := t.TempDir()
+	storage := NewFileStorage(torrent, root, "")
+	defer storage.Close()
+
+	download := &Download{Torrent: torrent, Storage: storage, Have: CreateBitfield(torrent.NumPieces())}
+	for i := 0; i < torrent.NumPieces(); i++ {
+		if err := storage.WriteAt(i, 0, data[i*16:i*16+torrent.PieceSize(i)]); err != nil {
+			t.Fatal(err)
+		}
+		download.Have.SetPiece(i)
+	}
+
+	script := filepath.Join(root, "finish", "run.sh")
+	os.Chmod(script, 0640)
+
+	// The second piece is where the script ends and the other file starts.
+	download.finishFiles(1)
+
+	if info, err := os.Stat(script); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("script has mode %v, %v, want 0750", info.Mode().Perm(), err)
+	}
+
+	// The script's sha1 in the torrent is wrong.
+	if failed := download.FailedFiles; len(failed) != 1 || failed[0] != "run.sh" {
+		t.Errorf("files failing their sha1 check: %v", failed)
+	}
+}
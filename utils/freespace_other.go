@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package utils
+
+import "os"
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errFreeSpaceUnsupported
+}
+
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+// sameFilesystem can't tell filesystems apart here, but free space isn't
+// checked either.
+func sameFilesystem(a string, b string) bool {
+	return true
+}
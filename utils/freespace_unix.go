@@ -0,0 +1,44 @@
+//go:build linux || darwin || freebsd
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// allocatedSize is how much of a file is actually stored on disk, which is
+// less than its size when it is sparse.
+func allocatedSize(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+
+	return info.Size()
+}
+
+// sameFilesystem reports whether two existing paths are on one device, so that
+// moving between them is a rename.
+func sameFilesystem(a string, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	statA, okA := infoA.Sys().(*syscall.Stat_t)
+	statB, okB := infoB.Sys().(*syscall.Stat_t)
+
+	return okA && okB && statA.Dev == statB.Dev
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func freeSpace(dir string) (int64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var available uint64
+	ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&available)), 0, 0)
+	if ok == 0 {
+		return 0, err
+	}
+
+	return int64(available), nil
+}
+
+// allocatedSize is the file size on Windows, where extending a file reserves
+// the space for it.
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+// sameFilesystem reports whether two paths are on one volume, so that moving
+// between them is a rename.
+func sameFilesystem(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	return strings.EqualFold(filepath.VolumeName(absA), filepath.VolumeName(absB))
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errHashPoolClosed = errors.New("hash pool closed")
+
+// HashPool verifies downloaded pieces on a fixed number of workers, so peers
+// can carry on downloading while earlier pieces are hashed.
+type HashPool struct {
+	verify func(index int, piece []byte) bool
+	jobs   chan hashJob
+	quit   chan struct{}
+	stats  HashStats
+	lock   sync.Mutex
+}
+
+type hashJob struct {
+	index int
+	piece []byte
+	done  func(valid bool)
+}
+
+// HashStats shows whether hashing keeps up: Queued counts pieces waiting for or
+// being verified, and MaxQueued is the most there have been at once.
+type HashStats struct {
+	Queued    int
+	MaxQueued int
+	Verified  int
+	Failed    int
+	HashTime  time.Duration
+}
+
+func NewHashPool(workers int, verify func(index int, piece []byte) bool) *HashPool {
+	pool := &HashPool{
+		verify: verify,
+		jobs:   make(chan hashJob, workers*2),
+		quit:   make(chan struct{}),
+	}
+
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+func (pool *HashPool) work() {
+	for {
+		select {
+		case job := <-pool.jobs:
+			start := time.Now()
+			valid := pool.verify(job.index, job.piece)
+
+			pool.lock.Lock()
+			pool.stats.Queued -= 1
+			pool.stats.HashTime += time.Since(start)
+			if valid {
+				pool.stats.Verified += 1
+			} else {
+				pool.stats.Failed += 1
+			}
+			pool.lock.Unlock()
+
+			job.done(valid)
+		case <-pool.quit:
+			return
+		}
+	}
+}
+
+// Submit queues a piece for verification and calls done with the result from a
+// worker. It blocks while the queue is full, which holds back the peers
+// feeding it rather than buffering pieces without limit. If the pool is closed
+// meanwhile, done is never called and Submit returns an error.
+func (pool *HashPool) Submit(index int, piece []byte, done func(valid bool)) error {
+	pool.lock.Lock()
+	pool.stats.Queued += 1
+	if pool.stats.Queued > pool.stats.MaxQueued {
+		pool.stats.MaxQueued = pool.stats.Queued
+	}
+	pool.lock.Unlock()
+
+	job := hashJob{index: index, piece: piece, done: done}
+
+	select {
+	case pool.jobs <- job:
+		return nil
+	default:
+		Debugf("Hash queue is full, waiting to verify piece %d", index)
+	}
+
+	select {
+	case pool.jobs <- job:
+		return nil
+	case <-pool.quit:
+		pool.lock.Lock()
+		pool.stats.Queued -= 1
+		pool.lock.Unlock()
+
+		return errHashPoolClosed
+	}
+}
+
+func (pool *HashPool) Stats() HashStats {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	return pool.stats
+}
+
+func (pool *HashPool) Close() {
+	close(pool.quit)
+}
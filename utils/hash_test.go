@@ -0,0 +1,28 @@
+package utils
+
+import "testing"
+
+func TestHashPoolSubmitAfterClose(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	pool := NewHashPool(1, func(index int, piece []byte) bool {
+		<-release
+		return true
+	})
+	pool.Close()
+
+	// Submissions fill the queue, then fail instead of blocking or dropping
+	// the piece silently.
+	for i := 0; i < 10; i++ {
+		err := pool.Submit(i, nil, func(valid bool) {})
+		if err == errHashPoolClosed {
+			if queued := pool.Stats().Queued; queued > 3 {
+				t.Errorf("%d pieces counted as queued", queued)
+			}
+			return
+		}
+	}
+
+	t.Fatal("Submit kept accepting pieces after the pool closed")
+}
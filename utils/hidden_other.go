@@ -0,0 +1,9 @@
+//go:build !windows
+
+package utils
+
+// Outside Windows a file is hidden by its name alone, which we can't change
+// without breaking the torrent's paths.
+func setHidden(path string) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+package utils
+
+import "syscall"
+
+func setHidden(path string) error {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := syscall.GetFileAttributes(pathPtr)
+	if err != nil {
+		return err
+	}
+
+	return syscall.SetFileAttributes(pathPtr, attrs|syscall.FILE_ATTRIBUTE_HIDDEN)
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Listen accepts incoming peers over TCP and, if UseUTP is set, over uTP on the
+// same port number.
+func (download *Download) Listen(port uint16) (net.Listener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	download.Port = uint16(listener.Addr().(*net.TCPAddr).Port)
+	download.Extensions.Port = int(download.Port)
+
+	go download.acceptLoop(listener)
+
+	if download.UseUTP {
+		socket, err := ListenUTP(download.Port)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+
+		download.UTP = socket
+		go download.acceptLoop(socket)
+	}
+
+	return listener, nil
+}
+
+func (download *Download) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go download.AcceptPeer(conn)
+	}
+}
+
+func (download *Download) AcceptPeer(conn net.Conn) {
+	var addr *net.UDPAddr
+	overUTP := false
+	switch remote := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		addr = &net.UDPAddr{IP: remote.IP, Port: remote.Port, Zone: remote.Zone}
+	case *net.UDPAddr:
+		addr = remote
+		overUTP = true
+	default:
+		conn.Close()
+		return
+	}
+
+	peer := Peer{IP: addr.IP, Port: uint16(addr.Port), Zone: addr.Zone}
+	if !download.Allowed(peer) {
+		conn.Close()
+		return
+	}
+
+	conn, err := download.acceptEncryption(conn)
+	if err != nil {
+		Debugf("Incoming encryption negotiation failed: %s: %s", peer.IP.String(), err)
+		conn.Close()
+		return
+	}
+
+	err = peer.AcceptHandshake(conn, download.Torrent)
+	if err != nil {
+		Debugf("Incoming handshake failed: %s", peer.IP.String())
+		conn.Close()
+		return
+	}
+
+	// uTP shares the listening port, so we can reach the peer the same way.
+	if overUTP {
+		download.lock.Lock()
+		download.utpPeers[peer.Address()] = true
+		download.lock.Unlock()
+	}
+
+	download.requestPieces(peer)
+}
+
+// acceptEncryption tells a plaintext handshake apart from the start of an MSE
+// negotiation and applies the encryption policy to either.
+func (download *Download) acceptEncryption(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	start, err := reader.Peek(20)
+	if err != nil {
+		return conn, err
+	}
+
+	if start[0] == 19 && string(start[1:20]) == "BitTorrent protocol" {
+		if GetEncryption() == "require" {
+			return conn, errors.New("plaintext connections are not allowed")
+		}
+
+		return &cryptoConn{Conn: conn, reader: reader}, nil
+	}
+
+	if GetEncryption() == "disable" {
+		return conn, errors.New("encrypted connections are not allowed")
+	}
+
+	infoHashes := [][20]byte{download.Torrent.InfoHash}
+	if download.Torrent.MetaVersion == 2 {
+		var truncated [20]byte
+		copy(truncated[:], download.Torrent.InfoHashV2[:])
+		infoHashes = append(infoHashes, truncated)
+	}
+
+	encrypted, err := AcceptEncryption(conn, reader, infoHashes, CryptoMethods())
+	if err != nil {
+		return conn, err
+	}
+
+	return encrypted, nil
+}
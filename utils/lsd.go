@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local Service Discovery (BEP 14) finds peers on the local network by
+// multicasting the info hash and our port, so they connect without a tracker.
+const lsdInterval = 5 * time.Minute
+
+var errPrivateTorrent = errors.New("private torrents can't use local discovery")
+
+// LSDGroups are the multicast groups BEP 14 announces on.
+var LSDGroups = []*net.UDPAddr{
+	{IP: net.IPv4(239, 192, 152, 143), Port: 6771},
+	{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771},
+}
+
+type LocalDiscovery struct {
+	download *Download
+	port     uint16
+
+	// cookie tells our own announces, which may be looped back, from others.
+	cookie string
+	groups []lsdGroup
+	quit   chan struct{}
+}
+
+type lsdGroup struct {
+	addr *net.UDPAddr
+	conn *net.UDPConn
+	send net.PacketConn
+}
+
+// StartLocalDiscovery joins the discovery groups, normally LSDGroups, on the
+// named interface, or on the system's default one if name is empty, and
+// announces the download on them. Groups that can't be joined, such as IPv6 on
+// an IPv4-only network, are skipped. Private torrents (BEP 27) are refused.
+func StartLocalDiscovery(download *Download, port uint16, name string, groups []*net.UDPAddr) (*LocalDiscovery, error) {
+	if download.Torrent.Private {
+		return nil, errPrivateTorrent
+	}
+
+	var ifi *net.Interface
+	if len(name) > 0 {
+		var err error
+		ifi, err = net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	discovery := &LocalDiscovery{
+		download: download,
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		quit:     make(chan struct{}),
+	}
+
+	for _, addr := range groups {
+		network := "udp4"
+		if addr.IP.To4() == nil {
+			network = "udp6"
+		}
+
+		conn, err := net.ListenMulticastUDP(network, ifi, addr)
+		if err != nil {
+			Debugf("Can't join local discovery group %s: %s", addr, err)
+			continue
+		}
+
+		// Listening sockets don't loop multicasts back to this host, so announce
+		// from a separate socket unless an interface was picked, which is then
+		// the only way to send on it.
+		var send net.PacketConn = conn
+		if ifi == nil {
+			send, err = net.ListenUDP(network, nil)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		group := lsdGroup{addr: addr, conn: conn, send: send}
+		discovery.groups = append(discovery.groups, group)
+
+		go discovery.receive(group)
+	}
+
+	go discovery.announceLoop()
+
+	return discovery, nil
+}
+
+func (discovery *LocalDiscovery) announceLoop() {
+	ticker := time.NewTicker(lsdInterval)
+	defer ticker.Stop()
+
+	for {
+		discovery.announce()
+
+		select {
+		case <-ticker.C:
+		case <-discovery.quit:
+			return
+		}
+	}
+}
+
+func (discovery *LocalDiscovery) announce() {
+	for _, group := range discovery.groups {
+		_, err := group.send.WriteTo(discovery.announcement(group.addr), group.addr)
+		if err != nil {
+			Debugf("Error announcing to local discovery group %s: %s", group.addr, err)
+		}
+	}
+}
+
+func (discovery *LocalDiscovery) announcement(addr *net.UDPAddr) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&message, "Host: %s\r\n", addr)
+	fmt.Fprintf(&message, "Port: %d\r\n", discovery.port)
+	fmt.Fprintf(&message, "Infohash: %s\r\n", hex.EncodeToString(discovery.download.Torrent.InfoHash[:]))
+	fmt.Fprintf(&message, "cookie: %s\r\n", discovery.cookie)
+	fmt.Fprintf(&message, "\r\n\r\n")
+
+	return message.Bytes()
+}
+
+func (discovery *LocalDiscovery) receive(group lsdGroup) {
+	buffer := make([]byte, 1500)
+
+	for {
+		n, addr, err := group.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		peer, ok := discovery.parse(buffer[:n], addr)
+		if ok {
+			Debugf("Found local peer %s", peer.Address())
+			discovery.download.AddPeers([]Peer{peer})
+		}
+	}
+}
+
+// parse reads an announce, returning the peer that sent it if it is someone
+// else announcing our torrent.
+func (discovery *LocalDiscovery) parse(packet []byte, addr *net.UDPAddr) (Peer, bool) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(packet)))
+
+	line, err := reader.ReadLine()
+	if err != nil || line != "BT-SEARCH * HTTP/1.1" {
+		return Peer{}, false
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return Peer{}, false
+	}
+
+	if header.Get("Cookie") == discovery.cookie {
+		return Peer{}, false
+	}
+
+	port, err := strconv.ParseUint(header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return Peer{}, false
+	}
+
+	for _, infoHash := range header.Values("Infohash") {
+		decoded, err := hex.DecodeString(strings.TrimSpace(infoHash))
+		if err == nil && discovery.download.Torrent.MatchesInfoHash(decoded) {
+			return Peer{IP: addr.IP, Port: uint16(port), Zone: addr.Zone, Source: SourceLSD}, true
+		}
+	}
+
+	return Peer{}, false
+}
+
+func (discovery *LocalDiscovery) Stop() {
+	close(discovery.quit)
+
+	for _, group := range discovery.groups {
+		group.conn.Close()
+		if group.send != group.conn {
+			group.send.Close()
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLocalDiscoveryLoopback(t *testing.T) {
+	// Announce on a free port so real clients on the network don't interfere.
+	free, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+
+	groups := []*net.UDPAddr{{IP: net.IPv4(239, 192, 152, 143), Port: port}}
+
+	var torrent TorrentFile
+	copy(torrent.InfoHash[:], "lsd test info hash..")
+
+	start := func(peerPort uint16) (*Download, *LocalDiscovery) {
+		download := &Download{Torrent: torrent, Bans: NewBanList(), knownPeers: make(map[string]bool)}
+
+		discovery, err := StartLocalDiscovery(download, peerPort, "lo", groups)
+		if err != nil {
+			t.Skipf("can't use loopback multicast: %s", err)
+		}
+		if len(discovery.groups) == 0 {
+			t.Skip("can't join a multicast group on loopback")
+		}
+
+		return download, discovery
+	}
+
+	// Nothing listens on these ports, so connecting to the found peers fails
+	// straight away.
+	downloadA, discoveryA := start(1)
+	defer discoveryA.Stop()
+	downloadB, discoveryB := start(2)
+	defer discoveryB.Stop()
+
+	// B missed A's first announce, which went out before B joined.
+	discoveryA.announce()
+
+	// Announces come from whichever address the system sends multicasts from,
+	// not necessarily 127.0.0.1, so peers are told apart by port.
+	found := func(download *Download, port int) bool {
+		download.lock.Lock()
+		defer download.lock.Unlock()
+
+		for address := range download.knownPeers {
+			_, peerPort, _ := net.SplitHostPort(address)
+			if peerPort == strconv.Itoa(port) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !found(downloadA, 2) || !found(downloadB, 1) {
+		if time.Now().After(deadline) {
+			t.Fatal("local peers didn't find each other")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if found(downloadA, 1) || found(downloadB, 2) {
+		t.Error("found ourselves through our own announce")
+	}
+}
+
+func TestLocalDiscoveryParse(t *testing.T) {
+	var torrent TorrentFile
+	copy(torrent.InfoHash[:], "lsd test info hash..")
+
+	ours := &LocalDiscovery{download: &Download{Torrent: torrent}, port: 6881, cookie: "ours"}
+	theirs := &LocalDiscovery{download: &Download{Torrent: torrent}, port: 6882, cookie: "theirs"}
+	group := LSDGroups[0]
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 6771}
+
+	if _, ok := ours.parse(ours.announcement(group), from); ok {
+		t.Error("accepted our own announce")
+	}
+
+	peer, ok := ours.parse(theirs.announcement(group), from)
+	if !ok {
+		t.Fatal("rejected another peer's announce")
+	}
+	if !peer.IP.Equal(from.IP) || peer.Port != 6882 {
+		t.Errorf("got peer %s, want 192.168.1.2:6882", peer.Address())
+	}
+
+	var other TorrentFile
+	copy(other.InfoHash[:], "another info hash...")
+	stranger := &LocalDiscovery{download: &Download{Torrent: other}, port: 6883, cookie: "stranger"}
+	if _, ok := ours.parse(stranger.announcement(group), from); ok {
+		t.Error("accepted an announce for another torrent")
+	}
+}
+
+func TestLocalDiscoveryPrivate(t *testing.T) {
+	// Listen on the group ourselves to catch anything announced.
+	free, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+
+	group := &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: port}
+	lo, _ := net.InterfaceByName("lo")
+	listener, err := net.ListenMulticastUDP("udp4", lo, group)
+	if err != nil {
+		t.Skipf("can't use loopback multicast: %s", err)
+	}
+	defer listener.Close()
+
+	torrent := TorrentFile{Private: true}
+	copy(torrent.InfoHash[:], "lsd test info hash..")
+	download := &Download{Torrent: torrent, Bans: NewBanList(), knownPeers: make(map[string]bool)}
+
+	discovery, err := StartLocalDiscovery(download, 6881, "lo", []*net.UDPAddr{group})
+	if err != errPrivateTorrent {
+		discovery.Stop()
+		t.Fatalf("got error %v starting discovery for a private torrent, want %v", err, errPrivateTorrent)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, _, err := listener.ReadFrom(make([]byte, 1500)); err == nil {
+		t.Errorf("announced a private torrent in %d bytes", n)
+	}
+}
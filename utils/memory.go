@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+)
+
+// MemoryStorage keeps the whole torrent in memory, which is only sensible for
+// small torrents and tests.
+type MemoryStorage struct {
+	Torrent TorrentFile
+	data    []byte
+	lock    sync.RWMutex
+}
+
+func NewMemoryStorage(torrent TorrentFile) *MemoryStorage {
+	return &MemoryStorage{
+		Torrent: torrent,
+		data:    make([]byte, torrent.Length),
+	}
+}
+
+func (storage *MemoryStorage) span(index int, begin int, length int) (int, error) {
+	offset := index*storage.Torrent.PieceLength + begin
+	if index < 0 || begin < 0 || offset+length > len(storage.data) {
+		return 0, errors.New("out of bounds")
+	}
+
+	return offset, nil
+}
+
+func (storage *MemoryStorage) ReadAt(index int, begin int, data []byte) error {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+
+	offset, err := storage.span(index, begin, len(data))
+	if err != nil {
+		return err
+	}
+
+	copy(data, storage.data[offset:])
+	return nil
+}
+
+func (storage *MemoryStorage) WriteAt(index int, begin int, data []byte) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	offset, err := storage.span(index, begin, len(data))
+	if err != nil {
+		return err
+	}
+
+	copy(storage.data[offset:], data)
+	return nil
+}
+
+func (storage *MemoryStorage) Flush() error {
+	return nil
+}
+
+func (storage *MemoryStorage) Close() error {
+	return nil
+}
+
+func (storage *MemoryStorage) Stat() (StorageStat, error) {
+	files := len(storage.Torrent.Files)
+	if files == 0 {
+		files = 1
+	}
+
+	return StorageStat{Files: files, Bytes: int64(len(storage.data))}, nil
+}
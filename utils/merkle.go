@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"crypto/sha256"
+)
+
+// BEP 52 hashes file data in 16 KiB blocks, which form the leaves of a
+// per-file SHA-256 merkle tree.
+const merkleBlockSize = 16384
+
+func merkleLeaves(data []byte) [][32]byte {
+	leaves := make([][32]byte, 0, (len(data)+merkleBlockSize-1)/merkleBlockSize)
+
+	for offset := 0; offset < len(data); offset += merkleBlockSize {
+		end := offset + merkleBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		leaves = append(leaves, sha256.Sum256(data[offset:end]))
+	}
+
+	return leaves
+}
+
+// merkleRoot computes the root of a tree `width` nodes wide, where width is a
+// power of two and nodes beyond the given hashes are filled with pad.
+func merkleRoot(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	var pair [64]byte
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			copy(pair[:32], layer[2*i][:])
+			copy(pair[32:], layer[2*i+1][:])
+			layer[i] = sha256.Sum256(pair[:])
+		}
+		layer = layer[:len(layer)/2]
+	}
+
+	return layer[0]
+}
+
+// zeroSubtreeRoot is the root of a subtree of `leaves` all-zero leaf hashes,
+// used to pad the piece layer out to a power of two.
+func zeroSubtreeRoot(leaves int) [32]byte {
+	return merkleRoot(nil, leaves, [32]byte{})
+}
+
+func nextPowerOfTwo(n int) int {
+	power := 1
+	for power < n {
+		power <<= 1
+	}
+
+	return power
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const testV2PieceLength = 2 * merkleBlockSize
+
+// testV2Torrent writes a v2-only torrent for the files, computing their
+// pieces roots and piece layers, and decodes it. The tamper function may
+// change the torrent before it's written.
+func testV2Torrent(t *testing.T, files map[string][]byte, tamper func(torrent map[string]any)) (TorrentFile, error) {
+	fileTree := make(map[string]any)
+	layers := make(map[string]any)
+
+	for name, data := range files {
+		var layer [][32]byte
+		for offset := 0; offset < len(data); offset += testV2PieceLength {
+			end := offset + testV2PieceLength
+			if end > len(data) {
+				end = len(data)
+			}
+			layer = append(layer, merkleRoot(merkleLeaves(data[offset:end]), testV2PieceLength/merkleBlockSize, [32]byte{}))
+		}
+
+		var root [32]byte
+		if len(data) <= testV2PieceLength {
+			leaves := merkleLeaves(data)
+			root = merkleRoot(leaves, nextPowerOfTwo(len(leaves)), [32]byte{})
+		} else {
+			root = merkleRoot(layer, nextPowerOfTwo(len(layer)), zeroSubtreeRoot(testV2PieceLength/merkleBlockSize))
+
+			var layerBytes []byte
+			for _, hash := range layer {
+				layerBytes = append(layerBytes, hash[:]...)
+			}
+			layers[string(root[:])] = string(layerBytes)
+		}
+
+		fileTree[name] = map[string]any{"": map[string]any{"length": int64(len(data)), "pieces root": string(root[:])}}
+	}
+
+	torrent := map[string]any{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]any{
+			"name":         "v2",
+			"piece length": int64(testV2PieceLength),
+			"meta version": int64(2),
+			"file tree":    fileTree,
+		},
+		"piece layers": layers,
+	}
+	if tamper != nil {
+		tamper(torrent)
+	}
+
+	path := filepath.Join(t.TempDir(), "v2.torrent")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := bencode.Marshal(file, torrent); err != nil {
+		t.Fatal(err)
+	}
+	file.Seek(0, 0)
+
+	return DecodeBencodedFile(file)
+}
+
+func TestV2VerifyPiece(t *testing.T) {
+	large := make([]byte, 2*testV2PieceLength+14464)
+	small := make([]byte, 1000)
+	rand.Read(large)
+	rand.Read(small)
+
+	torrent, err := testV2Torrent(t, map[string][]byte{"a.bin": large, "b.bin": small}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(torrent.InfoHash[:], torrent.InfoHashV2[:20]) {
+		t.Error("v2-only torrent isn't addressed by its truncated v2 info hash")
+	}
+
+	// Files start on piece boundaries, so a.bin is followed by padding.
+	if len(torrent.Files) != 3 || !torrent.Files[1].Padding || torrent.Length != 3*testV2PieceLength+len(small) {
+		t.Fatalf("files %+v of length %d", torrent.Files, torrent.Length)
+	}
+
+	data := append(append([]byte(nil), large...), make([]byte, torrent.Files[1].Length)...)
+	data = append(data, small...)
+
+	for i := 0; i < torrent.NumPieces(); i++ {
+		piece := append([]byte(nil), data[i*testV2PieceLength:i*testV2PieceLength+torrent.PieceSize(i)]...)
+		if !torrent.VerifyPiece(i, piece) {
+			t.Errorf("piece %d doesn't verify", i)
+		}
+
+		piece[0] ^= 0xff
+		if torrent.VerifyPiece(i, piece) {
+			t.Errorf("corrupted piece %d verifies", i)
+		}
+	}
+}
+
+func TestV2PieceLayerMismatch(t *testing.T) {
+	large := make([]byte, 3*testV2PieceLength)
+	rand.Read(large)
+
+	_, err := testV2Torrent(t, map[string][]byte{"a.bin": large}, func(torrent map[string]any) {
+		for root, layer := range torrent["piece layers"].(map[string]any) {
+			hashes := []byte(layer.(string))
+			hashes[0] ^= 0xff
+			torrent["piece layers"].(map[string]any)[root] = string(hashes)
+		}
+	})
+	if err == nil || !strings.Contains(err.Error(), "piece layer does not match pieces root") {
+		t.Errorf("got error %v for a tampered piece layer", err)
+	}
+
+	_, err = testV2Torrent(t, map[string][]byte{"a.bin": large}, func(torrent map[string]any) {
+		torrent["piece layers"] = map[string]any{}
+	})
+	if err == nil || !strings.Contains(err.Error(), "missing piece layer") {
+		t.Errorf("got error %v for a missing piece layer", err)
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	a, b := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))
+	pair := sha256.Sum256(append(a[:], b[:]...))
+
+	if root := merkleRoot([][32]byte{a, b}, 2, [32]byte{}); root != pair {
+		t.Error("root of two leaves isn't the hash of the pair")
+	}
+
+	// Padding a layer with a subtree root gives the same root as padding the
+	// leaves underneath it with zeros.
+	leaves := merkleRoot([][32]byte{a, b, a}, 8, [32]byte{})
+	layer := merkleRoot([][32]byte{pair, merkleRoot([][32]byte{a}, 2, [32]byte{})}, 4, zeroSubtreeRoot(2))
+	if leaves != layer {
+		t.Error("padding with zero subtree roots changes the root")
+	}
+}
@@ -20,8 +20,25 @@ const (
 	MsgRequest      messageID = 6
 	MsgPiece        messageID = 7
 	MsgCancel       messageID = 8
+
+	// Fast Extension (BEP 6)
+	MsgSuggest     messageID = 13
+	MsgHaveAll     messageID = 14
+	MsgHaveNone    messageID = 15
+	MsgReject      messageID = 16
+	MsgAllowedFast messageID = 17
 )
 
+// fast reports whether the message belongs to the Fast Extension, which peers
+// may only send once both sides have said they support it.
+func (id messageID) fast() bool {
+	return id >= MsgSuggest && id <= MsgAllowedFast
+}
+
+// maxMessageLength is large enough for a block or the bitfield of a torrent
+// with millions of pieces.
+const maxMessageLength = 1 << 21
+
 type Message struct {
 	ID      messageID
 	Payload []byte
@@ -37,8 +54,10 @@ func (m Message) ToBytes() []byte {
 	return buffer
 }
 
-func ReadMessage(conn net.Conn) (Message, error) {
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+// ReadMessage reads the next message, skipping keep-alives, and fails if
+// nothing arrives within timeout.
+func ReadMessage(conn net.Conn, timeout time.Duration) (Message, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
 
 	msgLength := make([]byte, 4)
 	if _, err := io.ReadFull(conn, msgLength); err != nil {
@@ -47,6 +66,15 @@ func ReadMessage(conn net.Conn) (Message, error) {
 	}
 	length := binary.BigEndian.Uint32(msgLength)
 
+	// Keep-alives have no ID or payload.
+	if length == 0 {
+		return ReadMessage(conn, timeout)
+	}
+
+	if length > maxMessageLength {
+		return Message{}, errors.New("message too long")
+	}
+
 	msgId := make([]byte, 1)
 	if _, err := io.ReadFull(conn, msgId); err != nil {
 		Debugf("Error reading message ID: %s", err)
@@ -54,15 +82,6 @@ func ReadMessage(conn net.Conn) (Message, error) {
 	}
 	id := messageID(msgId[0])
 
-	if id == MsgChoke || id == MsgUnchoke {
-		time.Sleep(time.Second)
-		return ReadMessage(conn)
-	}
-
-	if id > 8 {
-		return Message{}, errors.New("invalid message ID")
-	}
-
 	Debugf("Received message with length %d and ID %d from IP %s", length, id, conn.RemoteAddr().String())
 	buffer := make([]byte, length-1)
 	if _, err := io.ReadFull(conn, buffer); err != nil {
@@ -73,6 +92,16 @@ func ReadMessage(conn net.Conn) (Message, error) {
 	return Message{ID: messageID(id), Payload: buffer}, nil
 }
 
+// Index returns the piece index that have, request, piece, reject, suggest and
+// allowed fast messages start with.
+func (m Message) Index() (int, error) {
+	if len(m.Payload) < 4 {
+		return 0, errors.New("message too short")
+	}
+
+	return int(binary.BigEndian.Uint32(m.Payload[0:4])), nil
+}
+
 func RequestMessage(index int, offset int, blockSize int) Message {
 	requestPayload := make([]byte, 12)
 	binary.BigEndian.PutUint32(requestPayload[0:4], uint32(index))
@@ -0,0 +1,182 @@
+//go:build linux || darwin || freebsd
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// MmapStorage maps each of the torrent's files into memory, leaving it to the
+// kernel to page data in and out.
+type MmapStorage struct {
+	Torrent  TorrentFile
+	Root     string
+	Suffix   string
+	mappings map[int][]byte
+	lock     sync.RWMutex
+}
+
+func NewMmapStorage(torrent TorrentFile, root string, suffix string) (*MmapStorage, error) {
+	storage := &MmapStorage{
+		Torrent:  torrent,
+		Root:     root,
+		Suffix:   suffix,
+		mappings: make(map[int][]byte),
+	}
+
+	err := storage.mapFiles()
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+func (storage *MmapStorage) mapFiles() error {
+	torrent := storage.Torrent
+
+	for _, fileRange := range torrent.FileRanges(0, torrent.Length) {
+		if fileRange.Padding || fileRange.Length == 0 {
+			continue
+		}
+
+		mapping, err := mmapFile(storage.FilePath(fileRange.Path), fileRange.Length)
+		if err != nil {
+			return err
+		}
+
+		storage.mappings[fileRange.FileIndex] = mapping
+	}
+
+	return nil
+}
+
+func mmapFile(path string, length int) ([]byte, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	// The mapping stays valid after the descriptor is closed.
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() < int64(length) {
+		err = file.Truncate(int64(length))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return syscall.Mmap(int(file.Fd()), 0, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func (storage *MmapStorage) FilePath(path []string) string {
+	return storagePath(storage.Root, path, storage.Suffix)
+}
+
+func (storage *MmapStorage) ReadAt(index int, begin int, data []byte) error {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+
+	for _, fileRange := range storageRanges(storage.Torrent, index, begin, len(data)) {
+		mapping, ok := storage.mappings[fileRange.FileIndex]
+		if !ok {
+			return errors.New("storage is closed")
+		}
+
+		copy(data[fileRange.PieceOffset:fileRange.PieceOffset+fileRange.Length], mapping[fileRange.FileOffset:])
+	}
+
+	return nil
+}
+
+func (storage *MmapStorage) WriteAt(index int, begin int, data []byte) error {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+
+	for _, fileRange := range storageRanges(storage.Torrent, index, begin, len(data)) {
+		mapping, ok := storage.mappings[fileRange.FileIndex]
+		if !ok {
+			return errors.New("storage is closed")
+		}
+
+		copy(mapping[fileRange.FileOffset:], data[fileRange.PieceOffset:fileRange.PieceOffset+fileRange.Length])
+	}
+
+	return nil
+}
+
+func (storage *MmapStorage) Flush() error {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+
+	for _, mapping := range storage.mappings {
+		_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&mapping[0])), uintptr(len(mapping)), syscall.MS_SYNC)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
+
+func (storage *MmapStorage) Close() error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	return storage.unmapFiles()
+}
+
+// Move unmaps the files, moves them to their final names under root and maps
+// them again from there.
+func (storage *MmapStorage) Move(root string, progress func(moved int64, total int64)) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	err := storage.unmapFiles()
+	if err != nil {
+		return err
+	}
+
+	err = moveStored(storage.Torrent, storage.Root, storage.Suffix, root, progress)
+	if err != nil {
+		return err
+	}
+
+	storage.Root = root
+	storage.Suffix = ""
+
+	return storage.mapFiles()
+}
+
+func (storage *MmapStorage) unmapFiles() error {
+	var firstErr error
+	for fileIndex, mapping := range storage.mappings {
+		err := syscall.Munmap(mapping)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(storage.mappings, fileIndex)
+	}
+
+	return firstErr
+}
+
+func (storage *MmapStorage) Stat() (StorageStat, error) {
+	return statFiles(storage.Torrent, storage.FilePath)
+}
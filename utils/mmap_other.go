@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package utils
+
+import (
+	"errors"
+)
+
+// NewMmapStorage fails where syscall.Mmap isn't available.
+func NewMmapStorage(torrent TorrentFile, root string, suffix string) (Storage, error) {
+	return nil, errors.New("mmap storage is not supported on this platform")
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// moveStored moves every file of a torrent from one storage root to another,
+// dropping the in-progress suffix, then removes the directories left behind.
+// progress, if set, is told how many of the bytes to move have been moved.
+func moveStored(torrent TorrentFile, from string, suffix string, to string, progress func(moved int64, total int64)) error {
+	if from == to && len(suffix) == 0 {
+		return nil
+	}
+
+	var moved, total int64
+	for _, path := range storedPaths(torrent) {
+		if info, err := os.Lstat(storagePath(from, path, suffix)); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+	}
+
+	report := func(n int64) {
+		moved += n
+		if progress != nil {
+			progress(moved, total)
+		}
+	}
+
+	for _, path := range storedPaths(torrent) {
+		source := storagePath(from, path, suffix)
+
+		err := moveFile(source, storagePath(to, path, ""), report)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Clean up now-empty directories, stopping at the first one that isn't.
+		for dir := filepath.Dir(source); dir != filepath.Clean(from); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// moveFile renames a file, falling back to copying it when the destination is
+// on another filesystem. The copy is written next to the destination and then
+// renamed over it, so the final name never holds a partial file. report is
+// given the number of bytes moved as they are.
+func moveFile(source string, destination string, report func(n int64)) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(destination), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(source, destination)
+	if err == nil {
+		if info.Mode().IsRegular() {
+			report(info.Size())
+		}
+		return nil
+	}
+
+	temp := destination + ".tmp"
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+
+		err = os.Symlink(target, temp)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = copyFile(source, temp, info.Mode().Perm(), report)
+		if err != nil {
+			os.Remove(temp)
+			return err
+		}
+	}
+
+	err = os.Rename(temp, destination)
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	return os.Remove(source)
+}
+
+func copyFile(source string, destination string, perm os.FileMode, report func(n int64)) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(progressWriter{out, report}, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// progressWriter reports the bytes written through it.
+type progressWriter struct {
+	io.Writer
+	report func(n int64)
+}
+
+func (writer progressWriter) Write(data []byte) (int, error) {
+	n, err := writer.Writer.Write(data)
+	writer.report(int64(n))
+
+	return n, err
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompleteMovesInBackground(t *testing.T) {
+	data := []byte("a finished download, moved out of the incomplete directory")
+	torrent := checkTorrent(data, 16)
+
+	incomplete, save := t.TempDir(), t.TempDir()
+	storage := NewFileStorage(torrent, incomplete, ".part")
+	defer storage.Close()
+
+	for i := 0; i < torrent.NumPieces(); i++ {
+		if err := storage.WriteAt(i, 0, data[i*16:i*16+torrent.PieceSize(i)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if HasStoredData(torrent, save) {
+		t.Error("found data in an empty save path")
+	}
+
+	download := &Download{Torrent: torrent, Storage: storage, SavePath: save, Completed: make(chan struct{}), Bans: NewBanList(), Hashes: NewHashPool(1, nil)}
+	defer download.Hashes.Close()
+
+	// complete returns while the storage is still busy, leaving the move to
+	// another goroutine.
+	storage.lock.Lock()
+	download.complete()
+	storage.lock.Unlock()
+
+	select {
+	case <-download.Completed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("download wasn't moved")
+	}
+
+	status := download.Status()
+	if status.Moving || status.Moved != int64(len(data)) || status.MoveSize != int64(len(data)) {
+		t.Errorf("moving %v with %d of %d bytes moved after completing", status.Moving, status.Moved, status.MoveSize)
+	}
+
+	moved, err := os.ReadFile(filepath.Join(save, "check"))
+	if err != nil || !bytes.Equal(moved, data) {
+		t.Errorf("moved file holds %q, %v", moved, err)
+	}
+	if !HasStoredData(torrent, save) {
+		t.Error("didn't find the moved data in the save path")
+	}
+}
@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Message Stream Encryption obfuscates the BitTorrent handshake and,
+// optionally, the rest of the connection. Both sides agree on a shared secret
+// with Diffie-Hellman, derive RC4 keys from it and the info hash, and the
+// receiving side picks plaintext (header only) or RC4 for what follows.
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+
+	mseKeyLength = 96
+	mseMaxPad    = 512
+	mseTimeout   = 10 * time.Second
+)
+
+var msePrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+// cryptoConn is a connection after MSE negotiation. Reads go through the
+// buffer used while negotiating and writes are encrypted if RC4 was selected.
+type cryptoConn struct {
+	net.Conn
+	reader  io.Reader
+	encrypt *rc4.Cipher
+	lock    sync.Mutex
+}
+
+func (conn *cryptoConn) Read(data []byte) (int, error) {
+	return conn.reader.Read(data)
+}
+
+func (conn *cryptoConn) Write(data []byte) (int, error) {
+	if conn.encrypt == nil {
+		return conn.Conn.Write(data)
+	}
+
+	// The cipher is a stream, so concurrent writes must not interleave.
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	encrypted := make([]byte, len(data))
+	conn.encrypt.XORKeyStream(encrypted, data)
+
+	return conn.Conn.Write(encrypted)
+}
+
+type rc4Reader struct {
+	reader io.Reader
+	cipher *rc4.Cipher
+}
+
+func (reader rc4Reader) Read(data []byte) (int, error) {
+	n, err := reader.reader.Read(data)
+	reader.cipher.XORKeyStream(data[:n], data[:n])
+
+	return n, err
+}
+
+// EncryptConnection negotiates MSE as the connecting side, sending the
+// handshake as the initial payload. provide is the set of crypto methods we
+// accept.
+func EncryptConnection(conn net.Conn, infoHash [20]byte, handshake []byte, provide uint32) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(public, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	secret, err := mseSecret(reader, private)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypt := mseCipher("keyA", secret, infoHash[:])
+	decrypt := mseCipher("keyB", secret, infoHash[:])
+
+	req2 := mseHash("req2", infoHash[:])
+	req3 := mseHash("req3", secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+
+	payload := make([]byte, 8, 16+len(handshake))
+	payload = appendUint32(payload, provide)
+	payload = append(payload, 0, 0) // no padding
+	payload = appendUint16(payload, uint16(len(handshake)))
+	payload = append(payload, handshake...)
+	encrypt.XORKeyStream(payload, payload)
+
+	message := append(mseHash("req1", secret), req2...)
+	if _, err := conn.Write(append(message, payload...)); err != nil {
+		return nil, err
+	}
+
+	// The reply starts after the other side's padding, so look for the
+	// verification constant, eight zero bytes, as they would be encrypted.
+	verification := make([]byte, 8)
+	mseCipher("keyB", secret, infoHash[:]).XORKeyStream(verification, verification)
+	if err := mseSync(reader, verification, mseMaxPad); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(verification, verification)
+
+	reply := make([]byte, 6)
+	if _, err := io.ReadFull(reader, reply); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(reply, reply)
+
+	selected := binary.BigEndian.Uint32(reply[0:4])
+	padLength := int(binary.BigEndian.Uint16(reply[4:6]))
+	if padLength > mseMaxPad {
+		return nil, errors.New("invalid encryption padding")
+	}
+
+	pad := make([]byte, padLength)
+	if _, err := io.ReadFull(reader, pad); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(pad, pad)
+
+	switch {
+	case selected == cryptoRC4 && provide&cryptoRC4 != 0:
+		return &cryptoConn{Conn: conn, reader: rc4Reader{reader, decrypt}, encrypt: encrypt}, nil
+	case selected == cryptoPlaintext && provide&cryptoPlaintext != 0:
+		return &cryptoConn{Conn: conn, reader: reader}, nil
+	default:
+		return nil, errors.New("peer selected an unsupported crypto method")
+	}
+}
+
+// AcceptEncryption negotiates MSE as the receiving side. The returned
+// connection replays the initial payload, usually the handshake, before the
+// rest of the stream.
+func AcceptEncryption(conn net.Conn, reader *bufio.Reader, infoHashes [][20]byte, allowed uint32) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := mseSecret(reader, private)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(public, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	if err := mseSync(reader, mseHash("req1", secret), mseMaxPad); err != nil {
+		return nil, err
+	}
+
+	obfuscated := make([]byte, 20)
+	if _, err := io.ReadFull(reader, obfuscated); err != nil {
+		return nil, err
+	}
+
+	req3 := mseHash("req3", secret)
+	var infoHash []byte
+	for _, candidate := range infoHashes {
+		req2 := mseHash("req2", candidate[:])
+		for i := range req2 {
+			req2[i] ^= req3[i]
+		}
+
+		if bytes.Equal(req2, obfuscated) {
+			infoHash = candidate[:]
+			break
+		}
+	}
+	if infoHash == nil {
+		return nil, errors.New("encrypted handshake for an unknown torrent")
+	}
+
+	decrypt := mseCipher("keyA", secret, infoHash)
+	encrypt := mseCipher("keyB", secret, infoHash)
+
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	if !bytes.Equal(header[0:8], make([]byte, 8)) {
+		return nil, errors.New("invalid encryption verification constant")
+	}
+
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLength := int(binary.BigEndian.Uint16(header[12:14]))
+	if padLength > mseMaxPad {
+		return nil, errors.New("invalid encryption padding")
+	}
+
+	// Skip the padding, then read the length of the initial payload after it.
+	rest := make([]byte, padLength+2)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(rest, rest)
+
+	initial := make([]byte, binary.BigEndian.Uint16(rest[padLength:]))
+	if _, err := io.ReadFull(reader, initial); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(initial, initial)
+
+	selected := uint32(cryptoRC4)
+	if provide&allowed&cryptoRC4 == 0 {
+		selected = cryptoPlaintext
+	}
+	if provide&allowed&selected == 0 {
+		return nil, errors.New("no crypto method in common")
+	}
+
+	reply := make([]byte, 8, 14)
+	reply = appendUint32(reply, selected)
+	reply = append(reply, 0, 0) // no padding
+	encrypt.XORKeyStream(reply, reply)
+
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+
+	if selected == cryptoRC4 {
+		return &cryptoConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(initial), rc4Reader{reader, decrypt}), encrypt: encrypt}, nil
+	}
+
+	return &cryptoConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(initial), reader)}, nil
+}
+
+func mseKeyPair() (*big.Int, []byte, error) {
+	privateBytes := make([]byte, 20)
+	if _, err := rand.Read(privateBytes); err != nil {
+		return nil, nil, err
+	}
+
+	private := new(big.Int).SetBytes(privateBytes)
+	public := new(big.Int).Exp(big.NewInt(2), private, msePrime)
+
+	return private, msePadKey(public), nil
+}
+
+func mseSecret(reader io.Reader, private *big.Int) ([]byte, error) {
+	public := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(reader, public); err != nil {
+		return nil, err
+	}
+
+	secret := new(big.Int).Exp(new(big.Int).SetBytes(public), private, msePrime)
+
+	return msePadKey(secret), nil
+}
+
+// msePadKey encodes a key as a fixed 96-byte big-endian number.
+func msePadKey(key *big.Int) []byte {
+	padded := make([]byte, mseKeyLength)
+	key.FillBytes(padded)
+
+	return padded
+}
+
+func msePad() []byte {
+	length := make([]byte, 2)
+	rand.Read(length)
+
+	pad := make([]byte, int(binary.BigEndian.Uint16(length))%(mseMaxPad+1))
+	rand.Read(pad)
+
+	return pad
+}
+
+func mseHash(prefix string, parts ...[]byte) []byte {
+	hash := sha1.New()
+	hash.Write([]byte(prefix))
+	for _, part := range parts {
+		hash.Write(part)
+	}
+
+	return hash.Sum(nil)
+}
+
+// mseCipher returns an RC4 stream keyed for one direction, with the first
+// 1024 bytes of keystream discarded as the spec requires.
+func mseCipher(prefix string, secret []byte, infoHash []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(mseHash(prefix, secret, infoHash))
+
+	discard := make([]byte, 1024)
+	cipher.XORKeyStream(discard, discard)
+
+	return cipher
+}
+
+// mseSync reads until just after pattern, which must appear within maxSkip
+// bytes of padding.
+func mseSync(reader *bufio.Reader, pattern []byte, maxSkip int) error {
+	window := make([]byte, 0, maxSkip+len(pattern))
+
+	for len(window) < cap(window) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+
+	return errors.New("could not find encryption sync pattern")
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recordingConn keeps a copy of everything written to the connection.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+	lock    sync.Mutex
+}
+
+func (conn *recordingConn) Write(data []byte) (int, error) {
+	conn.lock.Lock()
+	conn.written.Write(data)
+	conn.lock.Unlock()
+
+	return conn.Conn.Write(data)
+}
+
+type mseResult struct {
+	conn    net.Conn
+	initial []byte
+	err     error
+}
+
+// testMSE negotiates encryption over loopback TCP and swaps a message each
+// way. It returns both ends and what the connecting side put on the wire.
+func testMSE(t *testing.T, infoHash [20]byte, provide uint32, allowed uint32) (net.Conn, mseResult, []byte, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan mseResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- mseResult{err: err}
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		known := [][20]byte{{0xee}, {0x01}}
+		encrypted, err := AcceptEncryption(conn, bufio.NewReader(conn), known, allowed)
+		if err != nil {
+			conn.Close()
+			accepted <- mseResult{err: err}
+			return
+		}
+
+		initial := make([]byte, 9)
+		if _, err := io.ReadFull(encrypted, initial); err != nil {
+			accepted <- mseResult{err: err}
+			return
+		}
+
+		encrypted.Write([]byte("reply"))
+		accepted <- mseResult{conn: encrypted, initial: initial}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	recording := &recordingConn{Conn: conn}
+	encrypted, err := EncryptConnection(recording, infoHash, []byte("handshake"), provide)
+	if err != nil {
+		conn.Close()
+		return nil, <-accepted, nil, err
+	}
+
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(encrypted, reply); err != nil || string(reply) != "reply" {
+		t.Fatalf("read reply %q, %v", reply, err)
+	}
+
+	recording.lock.Lock()
+	defer recording.lock.Unlock()
+
+	return encrypted, <-accepted, append([]byte(nil), recording.written.Bytes()...), nil
+}
+
+func TestMSERC4(t *testing.T) {
+	conn, accepted, written, err := testMSE(t, [20]byte{0x01}, cryptoRC4|cryptoPlaintext, cryptoRC4|cryptoPlaintext)
+	if err != nil || accepted.err != nil {
+		t.Fatalf("negotiation failed: %v, %v", err, accepted.err)
+	}
+
+	if string(accepted.initial) != "handshake" {
+		t.Errorf("initial payload %q, want the handshake", accepted.initial)
+	}
+	if conn.(*cryptoConn).encrypt == nil || accepted.conn.(*cryptoConn).encrypt == nil {
+		t.Error("RC4 wasn't selected")
+	}
+
+	// The rest of the stream is encrypted too.
+	conn.Write([]byte("after the handshake"))
+	received := make([]byte, 19)
+	if _, err := io.ReadFull(accepted.conn, received); err != nil || string(received) != "after the handshake" {
+		t.Errorf("received %q, %v", received, err)
+	}
+	if bytes.Contains(written, []byte("handshake")) {
+		t.Error("handshake went over the wire in plaintext")
+	}
+}
+
+func TestMSEPlaintext(t *testing.T) {
+	conn, accepted, written, err := testMSE(t, [20]byte{0x01}, cryptoRC4|cryptoPlaintext, cryptoPlaintext)
+	if err != nil || accepted.err != nil {
+		t.Fatalf("negotiation failed: %v, %v", err, accepted.err)
+	}
+
+	if conn.(*cryptoConn).encrypt != nil {
+		t.Error("RC4 was selected though only plaintext is allowed")
+	}
+
+	// Only the handshake is obfuscated.
+	conn.Write([]byte("after the handshake"))
+	received := make([]byte, 19)
+	if _, err := io.ReadFull(accepted.conn, received); err != nil || string(received) != "after the handshake" {
+		t.Errorf("received %q, %v", received, err)
+	}
+	if bytes.Contains(written, []byte("handshake")) {
+		t.Error("handshake went over the wire in plaintext")
+	}
+}
+
+func TestMSEFailures(t *testing.T) {
+	_, accepted, _, err := testMSE(t, [20]byte{0x02}, cryptoRC4|cryptoPlaintext, cryptoRC4|cryptoPlaintext)
+	if err == nil || accepted.err == nil || accepted.err.Error() != "encrypted handshake for an unknown torrent" {
+		t.Errorf("negotiated for an unknown torrent: %v, %v", err, accepted.err)
+	}
+
+	_, accepted, _, err = testMSE(t, [20]byte{0x01}, cryptoRC4, cryptoPlaintext)
+	if err == nil || accepted.err == nil || accepted.err.Error() != "no crypto method in common" {
+		t.Errorf("negotiated without a common crypto method: %v, %v", err, accepted.err)
+	}
+}
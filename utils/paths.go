@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxSegmentLength = 255
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SafePath turns the path segments from a torrent into path segments that are
+// safe to create under the download directory. Torrents with traversal segments
+// are rejected by ValidatePaths, but they are dropped here as well so nothing
+// can escape even if validation is skipped.
+func SafePath(segments []string) []string {
+	safe := make([]string, 0, len(segments))
+
+	for _, segment := range segments {
+		segment = sanitizeSegment(segment)
+		if len(segment) == 0 || segment == "." || segment == ".." {
+			continue
+		}
+
+		safe = append(safe, segment)
+	}
+
+	return safe
+}
+
+func sanitizeSegment(segment string) string {
+	segment = strings.ToValidUTF8(segment, "_")
+
+	segment = strings.Map(func(r rune) rune {
+		// Separators inside a segment would create directories, or an absolute path.
+		if r == '/' || r == '\\' || r < 0x20 {
+			return '_'
+		}
+
+		if runtime.GOOS == "windows" && strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+
+		return r
+	}, segment)
+
+	if runtime.GOOS == "windows" {
+		// Windows silently drops trailing dots and spaces, and refuses device names
+		// even with an extension.
+		segment = strings.TrimRight(segment, ". ")
+
+		base := strings.ToUpper(strings.SplitN(segment, ".", 2)[0])
+		if windowsReservedNames[base] {
+			segment = "_" + segment
+		}
+	}
+
+	return truncateSegment(segment)
+}
+
+// truncateSegment shortens a segment to the common filesystem limit, keeping
+// the extension and not splitting a UTF-8 sequence.
+func truncateSegment(segment string) string {
+	if len(segment) <= maxSegmentLength {
+		return segment
+	}
+
+	extension := filepath.Ext(segment)
+	if len(extension) > 16 {
+		extension = ""
+	}
+
+	base := segment[:maxSegmentLength-len(extension)]
+	for len(base) > 0 && !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+
+	return base + extension
+}
+
+// ValidatePaths rejects torrents whose paths try to leave the download
+// directory or that would write two files to the same place.
+func (torrent TorrentFile) ValidatePaths() error {
+	if err := validateSegments([]string{torrent.Name}); err != nil {
+		return fmt.Errorf("torrent name: %w", err)
+	}
+
+	// Case-insensitive filesystems are the default on Windows and macOS.
+	foldCase := runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	key := func(path []string) string {
+		joined := strings.Join(SafePath(path), "/")
+		if foldCase {
+			return strings.ToLower(joined)
+		}
+		return joined
+	}
+
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+
+	for _, file := range torrent.Files {
+		// Padding files are never written, so their paths don't matter.
+		if file.Padding {
+			continue
+		}
+
+		if err := validateSegments(file.Path); err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(file.Path, "/"), err)
+		}
+
+		if file.Symlink {
+			if err := validateSegments(file.SymlinkPath); err != nil {
+				return fmt.Errorf("%s: symlink target: %w", strings.Join(file.Path, "/"), err)
+			}
+		}
+
+		path := key(file.Path)
+		if files[path] || dirs[path] {
+			return fmt.Errorf("%s: collides with another file", strings.Join(file.Path, "/"))
+		}
+		files[path] = true
+
+		segments := SafePath(file.Path)
+		for i := 1; i < len(segments); i++ {
+			dir := key(segments[:i])
+			if files[dir] {
+				return fmt.Errorf("%s: parent directory collides with a file", strings.Join(file.Path, "/"))
+			}
+			dirs[dir] = true
+		}
+	}
+
+	return nil
+}
+
+func validateSegments(segments []string) error {
+	if len(segments) == 0 {
+		return errors.New("empty path")
+	}
+
+	for _, segment := range segments {
+		absolute := strings.HasPrefix(segment, "/") || strings.HasPrefix(segment, `\`) || filepath.VolumeName(segment) != ""
+		if segment == ".." || absolute {
+			return errors.New("path escapes the download directory")
+		}
+	}
+
+	if len(SafePath(segments)) == 0 {
+		return errors.New("empty path")
+	}
+
+	return nil
+}
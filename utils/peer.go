@@ -6,47 +6,213 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strconv"
 	"time"
 )
 
+const dialTimeout = 3 * time.Second
+
+// PeerSource is how we heard about a peer.
+type PeerSource int
+
+const (
+	SourceTracker PeerSource = iota
+	SourceLSD
+)
+
 type Peer struct {
-	IP         net.IP
-	Port       uint16
+	IP   net.IP
+	Port uint16
+
+	// Source is where the peer came from, as private torrents only take peers
+	// from their trackers.
+	Source PeerSource
+
+	// Zone is the interface of a link-local IPv6 address, which is only
+	// reachable through it.
+	Zone string
+
 	Connection net.Conn
 	Bitfield   Bitfield
+
+	// Fast is set when the peer supports the Fast Extension. AllowedFast holds
+	// the pieces it lets us request even while it chokes us.
+	Fast        bool
+	Unchoked    bool
+	AllowedFast map[int]bool
+
+	// Extended is set when the peer supports the extension protocol, and
+	// ExtensionHandshake holds what it last told us in its handshake.
+	Extended           bool
+	Extensions         *Extensions
+	ExtensionHandshake ExtensionHandshake
+
+	// UTP is set for peers known to accept uTP, and is the socket to reach them
+	// on. Other peers are dialed over TCP.
+	UTP *UTPSocket
+
+	// session is set once the connection is up, and guards Bitfield, Unchoked,
+	// AllowedFast and ExtensionHandshake from then on.
+	session *peerSession
 }
 
-func (peer *Peer) Handshake(torrent TorrentFile) error {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", peer.IP, peer.Port), time.Second*3)
+func (peer *Peer) HasPiece(index int) bool {
+	peer.session.lock.Lock()
+	defer peer.session.lock.Unlock()
 
-	if err != nil {
-		return err
+	return peer.Bitfield.HasPiece(index)
+}
+
+func (peer Peer) String() string {
+	return fmt.Sprintf("peer with IP %s", peer.IP)
+}
+
+// Address is the peer's host and port for dialing, with brackets around IPv6
+// addresses.
+func (peer Peer) Address() string {
+	host := peer.IP.String()
+	if len(peer.Zone) > 0 {
+		host += "%" + peer.Zone
 	}
 
+	return net.JoinHostPort(host, strconv.Itoa(int(peer.Port)))
+}
+
+func HandshakePacket(torrent TorrentFile) []byte {
 	pstr := "BitTorrent protocol"
 	peerID := sha1.Sum([]byte("-Tk8hj0wgej6ch"))
 
 	handshakePacket := make([]byte, 68)
 	copy(handshakePacket[0:1], []byte{uint8(len(pstr))}) // length of protocol identifier
 	copy(handshakePacket[1:20], []byte(pstr))            // protocol identifier
-	copy(handshakePacket[20:28], make([]byte, 8))        // extension support (all unsupported)
+	copy(handshakePacket[20:28], make([]byte, 8))        // extension support
 	copy(handshakePacket[28:48], torrent.InfoHash[:])    // info hash
 	copy(handshakePacket[48:68], peerID[:])              // peer ID
 
-	conn.Write(handshakePacket)
-	resp := make([]byte, 68)
-	_, err = conn.Read(resp)
+	if torrent.MetaVersion == 2 {
+		handshakePacket[27] |= 0x10 // BEP 52 v2 support
+	}
+
+	handshakePacket[25] |= 0x10 // BEP 10 extension protocol
+	handshakePacket[27] |= 0x04 // BEP 6 Fast Extension
+
+	return handshakePacket
+}
+
+func (peer *Peer) Handshake(torrent TorrentFile) error {
+	conn, err := peer.dial(torrent, GetEncryption() != "disable")
+	if err != nil && GetEncryption() == "prefer" {
+		Debugf("Encrypted handshake with %s failed, retrying in plaintext: %s", peer, err)
+		conn, err = peer.dial(torrent, false)
+	}
 
 	if err != nil {
 		return err
 	}
 
+	peer.Connection = conn
+
+	return nil
+}
+
+// connect reaches the peer over uTP when it's known to support it, falling back
+// to TCP, and over TCP otherwise.
+func (peer *Peer) connect() (net.Conn, error) {
+	addr := peer.Address()
+
+	if peer.UTP != nil {
+		conn, err := peer.UTP.Dial(addr, dialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+
+		Debugf("uTP connection to %s failed, trying TCP: %s", peer, err)
+	}
+
+	return net.DialTimeout("tcp", addr, dialTimeout)
+}
+
+func (peer *Peer) dial(torrent TorrentFile, encrypted bool) (net.Conn, error) {
+	conn, err := peer.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if encrypted {
+		// The handshake goes out as part of the encryption negotiation.
+		encryptedConn, err := EncryptConnection(conn, torrent.InfoHash, HandshakePacket(torrent), CryptoMethods())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = encryptedConn
+	} else {
+		conn.Write(HandshakePacket(torrent))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	resp := make([]byte, 68)
+	_, err = io.ReadFull(conn, resp)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	protocol := resp[0]
 	infoHash := resp[28:48]
 
 	if protocol != 19 || !bytes.Equal(torrent.InfoHash[:], infoHash) {
-		return errors.New("invalid handshake response")
+		conn.Close()
+		return nil, errors.New("invalid handshake response")
+	}
+
+	peer.Extended = resp[25]&0x10 != 0
+	peer.Fast = resp[27]&0x04 != 0
+
+	return conn, nil
+}
+
+// CryptoMethods returns the MSE crypto methods allowed by the encryption
+// level: RC4 for the whole stream, or only an obfuscated handshake.
+func CryptoMethods() uint32 {
+	switch GetEncryptionLevel() {
+	case "full":
+		return cryptoRC4
+	case "header":
+		return cryptoPlaintext
+	default:
+		return cryptoRC4 | cryptoPlaintext
+	}
+}
+
+// AcceptHandshake completes the handshake for a connection initiated by the
+// remote peer, which sends its handshake first.
+func (peer *Peer) AcceptHandshake(conn net.Conn, torrent TorrentFile) error {
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	resp := make([]byte, 68)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+
+	protocol := resp[0]
+	infoHash := resp[28:48]
+
+	if protocol != 19 || !torrent.MatchesInfoHash(infoHash) {
+		return errors.New("invalid handshake request")
+	}
+
+	peer.Extended = resp[25]&0x10 != 0
+	peer.Fast = resp[27]&0x04 != 0
+
+	if _, err := conn.Write(HandshakePacket(torrent)); err != nil {
+		return err
 	}
 
 	peer.Connection = conn
@@ -57,7 +223,20 @@ func (peer *Peer) Handshake(torrent TorrentFile) error {
 func (peer Peer) SendMessage(message Message) error {
 	Debugf("Sending message with length %d and ID %d to peer with IP %s", len(message.Payload), message.ID, peer.IP)
 
-	_, err := peer.Connection.Write(message.ToBytes())
+	return peer.write(message.ToBytes())
+}
+
+// write sends raw bytes, without interleaving them with messages sent from
+// other goroutines.
+func (peer Peer) write(data []byte) error {
+	if peer.session != nil {
+		peer.session.writeLock.Lock()
+		defer peer.session.writeLock.Unlock()
+
+		peer.session.lastWrite = time.Now()
+	}
+
+	_, err := peer.Connection.Write(data)
 	if err != nil {
 		return err
 	}
@@ -65,77 +244,234 @@ func (peer Peer) SendMessage(message Message) error {
 	return nil
 }
 
-func (peer Peer) GetPiece(index int, torrent TorrentFile) ([]byte, error) {
-	pieceSize := torrent.PieceLength
-	remainingBytes := torrent.Length - (index * torrent.PieceLength)
-	if remainingBytes < pieceSize {
-		pieceSize = remainingBytes
+// readMessage reads the next message from the peer and applies whatever it
+// changes about the peer's pieces or whether we may request from it.
+func (peer *Peer) readMessage(timeout time.Duration) (Message, error) {
+	message, err := ReadMessage(peer.Connection, timeout)
+	if err != nil {
+		return message, err
+	}
+
+	if message.ID == MsgExtended {
+		return message, peer.handleExtended(message.Payload)
 	}
 
+	if message.ID.fast() && !peer.Fast {
+		return message, errors.New("fast extension message from a peer without it")
+	}
+
+	peer.session.lock.Lock()
+	defer peer.session.lock.Unlock()
+
+	switch message.ID {
+	case MsgChoke:
+		peer.Unchoked = false
+	case MsgUnchoke:
+		peer.Unchoked = true
+	case MsgBitfield:
+		if len(message.Payload) != len(peer.Bitfield) {
+			return message, errors.New("invalid bitfield length")
+		}
+		peer.Bitfield = message.Payload
+	case MsgHave, MsgAllowedFast, MsgSuggest:
+		index, err := message.Index()
+		if err != nil || index >= len(peer.Bitfield)*8 {
+			return message, errors.New("invalid piece index")
+		}
+
+		switch message.ID {
+		case MsgHave:
+			peer.Bitfield.SetPiece(index)
+		case MsgAllowedFast:
+			peer.AllowedFast[index] = true
+		case MsgSuggest:
+			Debugf("%s suggests piece %d", peer, index)
+		}
+	case MsgHaveAll, MsgHaveNone:
+		if message.ID == MsgHaveAll {
+			for i := range peer.Bitfield {
+				peer.Bitfield[i] = 0xff
+			}
+		} else if message.ID == MsgHaveNone {
+			peer.Bitfield = CreateBitfield(len(peer.Bitfield) * 8)
+		}
+	}
+
+	return message, nil
+}
+
+// canRequest reports whether a request for the piece would be served rather
+// than dropped because the peer is choking us.
+func (peer *Peer) canRequest(index int) bool {
+	peer.session.lock.Lock()
+	defer peer.session.lock.Unlock()
+
+	return peer.Unchoked || peer.AllowedFast[index]
+}
+
+func (peer *Peer) GetPiece(index int, torrent TorrentFile) ([]byte, error) {
+	pieceSize := torrent.PieceSize(index)
 	piece := make([]byte, pieceSize)
 	blockSize := 16384
 	numBlocks := 1 + (pieceSize-1)/blockSize
+	events := peer.session.events
+
+	// Anything left over belongs to earlier requests.
+	for len(events) > 0 {
+		<-events
+	}
+
+	for !peer.canRequest(index) {
+		select {
+		case <-events:
+		case <-peer.session.done:
+			return nil, errPeerClosed
+		case <-time.After(requestTimeout):
+			return nil, errors.New("peer is choking us")
+		}
+	}
 
-	blockIndexChan := make(chan int, numBlocks+1)
+	for offset := 0; offset < pieceSize; offset += blockSize {
+		length := blockSize
+		if pieceSize-offset < length {
+			length = pieceSize - offset
+		}
 
-	for i := 0; i < 1; i++ {
-		go func() {
-			for {
-				blockIndex, more := <-blockIndexChan
-				if !more {
-					return
-				}
+		err := peer.SendMessage(RequestMessage(index, offset, length))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-				offset := blockIndex * blockSize
-				remainingBlockBytes := remainingBytes - offset
-				if remainingBlockBytes < blockSize {
-					blockSize = remainingBlockBytes
-				}
+	for received := 0; received < numBlocks; {
+		var message Message
+		select {
+		case message = <-events:
+		case <-peer.session.done:
+			return nil, errPeerClosed
+		case <-time.After(requestTimeout):
+			return nil, errors.New("timed out waiting for piece")
+		}
+
+		switch message.ID {
+		case MsgPiece:
+			if len(message.Payload) < 8 {
+				return nil, errors.New("invalid piece message")
+			}
 
-				peer.SendMessage(RequestMessage(index, offset, blockSize))
+			pieceIndex, _ := message.Index()
+			offset := int(binary.BigEndian.Uint32(message.Payload[4:8]))
+			if pieceIndex != index || offset+len(message.Payload[8:]) > pieceSize {
+				continue
 			}
-		}()
+
+			copy(piece[offset:], message.Payload[8:])
+			received++
+		case MsgReject:
+			if rejected, _ := message.Index(); rejected == index {
+				return nil, fmt.Errorf("peer rejected request for piece %d", index)
+			}
+		case MsgChoke:
+			// Peers with the Fast Extension reject each dropped request instead.
+			if !peer.Fast {
+				return nil, errors.New("peer choked us")
+			}
+		}
 	}
 
-	for i := 0; i < numBlocks; i++ {
-		blockIndexChan <- i
+	return piece, nil
+}
+
+// AnnounceInterested tells the peer which pieces we have, learns which it has,
+// and says whether we're interested in them.
+func (peer *Peer) AnnounceInterested(torrent TorrentFile, have Bitfield, interested bool) error {
+	peer.session = newPeerSession(torrent)
+	peer.Bitfield = CreateBitfield(torrent.NumPieces())
+	peer.AllowedFast = make(map[int]bool)
+
+	switch count := have.Count(); {
+	case peer.Fast && count == 0:
+		peer.SendMessage(Message{ID: MsgHaveNone})
+	case peer.Fast && count == torrent.NumPieces():
+		peer.SendMessage(Message{ID: MsgHaveAll})
+	default:
+		peer.SendMessage(Message{ID: MsgBitfield, Payload: have})
 	}
 
-	for i := 0; i < numBlocks; i++ {
-		message, err := ReadMessage(peer.Connection)
+	// Peers with the Fast Extension may request a few of our pieces while we
+	// choke them, which gets new peers started.
+	if peer.Fast {
+		peer.session.grantedFast = make(map[int]bool)
+		for _, index := range allowedFastSet(peer.IP, torrent.InfoHash, torrent.NumPieces(), allowedFastCount) {
+			if have.HasPiece(index) {
+				peer.session.grantedFast[index] = true
+				peer.SendMessage(Message{ID: MsgAllowedFast, Payload: appendUint32(nil, uint32(index))})
+			}
+		}
+	}
+
+	if peer.Extended {
+		err := peer.SendExtensionHandshake()
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
 
-		if message.ID != MsgPiece {
-			return nil, errors.New("failed to receive piece message")
+	// Apart from the extension handshake, which may come first, the first
+	// message says which pieces the peer has. Peers without the Fast Extension
+	// send nothing if they have no pieces.
+	for {
+		message, err := peer.readMessage(handshakeTimeout)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		} else if err != nil {
+			return err
 		}
 
-		offset := binary.BigEndian.Uint32(message.Payload[4:8])
-		copy(piece[offset:], message.Payload[8:])
+		if message.ID != MsgExtended {
+			break
+		}
 	}
 
-	close(blockIndexChan)
+	if interested {
+		peer.SendMessage(InterestedMessage())
+	}
 
-	return piece, nil
+	return nil
 }
 
-func (peer *Peer) AnnounceInterested(torrent TorrentFile) error {
-	bitfield := CreateBitfield(len(torrent.PieceHash))
-	bitfieldMessage := Message{
-		ID:      MsgBitfield,
-		Payload: bitfield,
+// allowedFastSet picks the pieces a peer may request from us while choked (BEP
+// 6). It depends only on the torrent and the peer's /24 network, so
+// reconnecting from a neighbouring address gets the same set. BEP 6 only
+// defines it for IPv4.
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces int, count int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
 	}
 
-	peer.SendMessage(bitfieldMessage)
-	bitfieldResponse, err := ReadMessage(peer.Connection)
-	if err != nil {
-		return err
+	if count > numPieces {
+		count = numPieces
 	}
 
-	peer.Bitfield = bitfieldResponse.Payload
+	x := append([]byte{ip4[0], ip4[1], ip4[2], 0}, infoHash[:]...)
+	set := make([]int, 0, count)
+	for len(set) < count {
+		hash := sha1.Sum(x)
+		x = hash[:]
 
-	peer.SendMessage(InterestedMessage())
+		for i := 0; i < 5 && len(set) < count; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
 
-	return nil
+			seen := false
+			for _, existing := range set {
+				seen = seen || existing == index
+			}
+			if !seen {
+				set = append(set, index)
+			}
+		}
+	}
+
+	return set
 }
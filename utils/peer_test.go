@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// The example from BEP 6.
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+
+	set := allowedFastSet(net.IPv4(80, 4, 4, 200), infoHash, 1313, 9)
+	want := []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+	if len(set) != len(want) {
+		t.Fatalf("got set %v, want %v", set, want)
+	}
+	for i := range want {
+		if set[i] != want[i] {
+			t.Fatalf("got set %v, want %v", set, want)
+		}
+	}
+
+	if set := allowedFastSet(net.IPv4(80, 4, 4, 200), infoHash, 3, 10); len(set) != 3 {
+		t.Errorf("got set %v for a torrent of 3 pieces", set)
+	}
+	if set := allowedFastSet(net.ParseIP("2001:db8::1"), infoHash, 1313, 10); len(set) != 0 {
+		t.Errorf("got set %v for an IPv6 peer", set)
+	}
+}
+
+func TestFastMessagesNeedNegotiation(t *testing.T) {
+	for _, id := range []messageID{MsgSuggest, MsgHaveAll, MsgHaveNone, MsgReject, MsgAllowedFast} {
+		for _, fast := range []bool{false, true} {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+
+			peer := &Peer{Connection: remote, Fast: fast, Bitfield: CreateBitfield(8), AllowedFast: make(map[int]bool), session: newPeerSession(TorrentFile{PieceLength: 16384})}
+			go local.Write(Message{ID: id, Payload: appendUint32(nil, 1)}.ToBytes())
+
+			_, err := peer.readMessage(time.Second)
+			if fast && err != nil {
+				t.Errorf("message %d after negotiating the Fast Extension: %s", id, err)
+			} else if !fast && err == nil {
+				t.Errorf("accepted message %d from a peer without the Fast Extension", id)
+			}
+		}
+	}
+}
+
+func TestServeAllowedFast(t *testing.T) {
+	data := []byte("pieces a choked peer may still request")
+	torrent := checkTorrent(data, 8)
+
+	storage := NewMemoryStorage(torrent)
+	have := CreateBitfield(torrent.NumPieces())
+	for i := 0; i < torrent.NumPieces(); i++ {
+		storage.WriteAt(i, 0, data[i*8:i*8+torrent.PieceSize(i)])
+		have.SetPiece(i)
+	}
+	download := &Download{Torrent: torrent, Storage: storage, Have: have}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// The peer is choked, with only piece 1 in its allowed fast set.
+	peer := &Peer{Connection: local, Fast: true, session: newPeerSession(torrent)}
+	peer.session.grantedFast = map[int]bool{1: true}
+
+	for _, index := range []int{1, 2} {
+		go download.serveRequest(peer, RequestMessage(index, 0, 8))
+
+		message, err := ReadMessage(remote, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case index == 1 && (message.ID != MsgPiece || !bytes.Equal(message.Payload[8:], data[8:16])):
+			t.Errorf("got message %d with %q for a piece in the allowed fast set", message.ID, message.Payload)
+		case index == 2 && message.ID != MsgReject:
+			t.Errorf("got message %d for a piece outside the allowed fast set, want a reject", message.ID)
+		}
+	}
+}
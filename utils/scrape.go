@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// udpMaxScrapeHashes is the most info hashes a UDP scrape can fit in one packet.
+const udpMaxScrapeHashes = 74
+
+type ScrapeResult struct {
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+// ScrapeURL derives the scrape URL from an HTTP announce URL, which is only
+// possible when the last path segment starts with "announce".
+func (tracker *Tracker) ScrapeURL() (*url.URL, error) {
+	scrapeURL := *tracker.AnnounceURL
+
+	slash := strings.LastIndex(scrapeURL.Path, "/")
+	if slash < 0 || !strings.HasPrefix(scrapeURL.Path[slash+1:], "announce") {
+		return nil, errors.New("tracker does not support scrape")
+	}
+
+	scrapeURL.Path = scrapeURL.Path[:slash+1] + "scrape" + strings.TrimPrefix(scrapeURL.Path[slash+1:], "announce")
+	scrapeURL.RawPath = ""
+
+	return &scrapeURL, nil
+}
+
+func (tracker *Tracker) Scrape(infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	if tracker.AnnounceURL.Scheme == "udp" {
+		return tracker.ScrapeUDP(infoHashes)
+	}
+
+	if tracker.AnnounceURL.Scheme == "https" || tracker.AnnounceURL.Scheme == "http" {
+		return tracker.ScrapeTCP(infoHashes)
+	}
+
+	return nil, errors.New("unsupported url scheme")
+}
+
+func (tracker *Tracker) ScrapeTCP(infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrapeURL, err := tracker.ScrapeURL()
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	for _, infoHash := range infoHashes {
+		q.Add("info_hash", string(infoHash[:]))
+	}
+	if len(scrapeURL.RawQuery) > 0 {
+		scrapeURL.RawQuery += "&"
+	}
+	scrapeURL.RawQuery += q.Encode()
+
+	client := http.Client{
+		Timeout: 5 * time.Second,
+	}
+	httpResp, err := client.Get(scrapeURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	decoded, err := bencode.Decode(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	decodedMap, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid scrape response")
+	}
+
+	if failure, ok := decodedMap["failure reason"].(string); ok {
+		return nil, fmt.Errorf("tracker failure: %s", failure)
+	}
+
+	files, ok := decodedMap["files"].(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid scrape response")
+	}
+
+	results := make(map[[20]byte]ScrapeResult)
+	for key, value := range files {
+		stats, ok := value.(map[string]any)
+		if !ok || len(key) != 20 {
+			continue
+		}
+
+		var infoHash [20]byte
+		copy(infoHash[:], key)
+
+		results[infoHash] = ScrapeResult{
+			Seeders:   bencodeInt(stats["complete"]),
+			Leechers:  bencodeInt(stats["incomplete"]),
+			Completed: bencodeInt(stats["downloaded"]),
+		}
+	}
+
+	return results, nil
+}
+
+func (tracker *Tracker) ScrapeUDP(infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	if len(infoHashes) > udpMaxScrapeHashes {
+		return nil, fmt.Errorf("UDP scrape is limited to %d info hashes", udpMaxScrapeHashes)
+	}
+
+	conn, err := net.Dial("udp", tracker.AnnounceURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	payload := make([]byte, 0, 20*len(infoHashes))
+	for _, infoHash := range infoHashes {
+		payload = append(payload, infoHash[:]...)
+	}
+
+	resp, err := tracker.udpRequest(conn, udpActionScrape, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[[20]byte]ScrapeResult)
+	for i, infoHash := range infoHashes {
+		offset := i * 12
+		if offset+12 > len(resp) {
+			break
+		}
+
+		results[infoHash] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(resp[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(resp[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(resp[offset+8 : offset+12])),
+		}
+	}
+
+	return results, nil
+}
+
+func bencodeInt(value any) int {
+	if i, ok := value.(int64); ok {
+		return int(i)
+	}
+
+	return 0
+}
@@ -0,0 +1,575 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	serverAnnounceInterval = 30 * time.Minute
+	serverMinInterval      = 5 * time.Minute
+	serverDefaultNumWant   = 50
+	serverMaxNumWant       = 200
+
+	// Announces and scrapes are small GET requests, so slow clients don't
+	// get to hold connections open for long.
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 30 * time.Second
+)
+
+type swarmPeer struct {
+	PeerID   [20]byte
+	IP       net.IP
+	Port     uint16
+	Left     uint64
+	LastSeen time.Time
+
+	// IPv6 is set for a peer that announced over IPv4 but gave an IPv6 address
+	// too (BEP 7), so IPv6 peers can still reach it.
+	IPv6 net.IP
+}
+
+func (peer swarmPeer) addresses() []net.IP {
+	if peer.IPv6 == nil {
+		return []net.IP{peer.IP}
+	}
+
+	return []net.IP{peer.IP, peer.IPv6}
+}
+
+type swarm struct {
+	Peers     map[[20]byte]*swarmPeer
+	Completed int
+}
+
+// TrackerServer is an in-memory tracker speaking both the HTTP and the UDP
+// (BEP 15) announce and scrape protocols.
+type TrackerServer struct {
+	Interval  time.Duration
+	Whitelist map[[20]byte]bool
+	lock      sync.Mutex
+	swarms    map[[20]byte]*swarm
+	secret    [20]byte
+	quit      chan struct{}
+	closers   []func() error
+}
+
+func NewTrackerServer() *TrackerServer {
+	server := &TrackerServer{
+		Interval: serverAnnounceInterval,
+		swarms:   make(map[[20]byte]*swarm),
+		quit:     make(chan struct{}),
+	}
+	rand.Read(server.secret[:])
+
+	return server
+}
+
+// LoadWhitelist restricts the tracker to the info hashes listed, one per line
+// in hex, in the given file.
+func (server *TrackerServer) LoadWhitelist(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	whitelist := make(map[[20]byte]bool)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(line)
+		if err != nil || len(decoded) != 20 {
+			return fmt.Errorf("invalid info hash %q", line)
+		}
+
+		var infoHash [20]byte
+		copy(infoHash[:], decoded)
+		whitelist[infoHash] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	server.lock.Lock()
+	server.Whitelist = whitelist
+	server.lock.Unlock()
+
+	return nil
+}
+
+// ListenAndServe serves HTTP and UDP on the same address, and expires peers
+// that haven't announced in a while, until Close is called.
+func (server *TrackerServer) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", server.HandleAnnounce)
+	mux.HandleFunc("/scrape", server.HandleScrape)
+	httpServer := &http.Server{Handler: mux, ReadHeaderTimeout: serverReadHeaderTimeout, ReadTimeout: serverReadTimeout}
+
+	server.closers = append(server.closers, httpServer.Close, packetConn.Close)
+
+	go httpServer.Serve(listener)
+	go server.ServeUDP(packetConn)
+	go server.expirePeers()
+
+	return nil
+}
+
+func (server *TrackerServer) Close() {
+	close(server.quit)
+
+	for _, closer := range server.closers {
+		closer()
+	}
+}
+
+func (server *TrackerServer) expirePeers() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Peers get two intervals to re-announce before we forget them.
+			deadline := time.Now().Add(-2 * server.Interval)
+
+			server.lock.Lock()
+			for infoHash, s := range server.swarms {
+				for peerID, peer := range s.Peers {
+					if peer.LastSeen.Before(deadline) {
+						delete(s.Peers, peerID)
+					}
+				}
+
+				if len(s.Peers) == 0 && s.Completed == 0 {
+					delete(server.swarms, infoHash)
+				}
+			}
+			server.lock.Unlock()
+		case <-server.quit:
+			return
+		}
+	}
+}
+
+// announce records the announcing peer and returns up to numWant other peers.
+func (server *TrackerServer) announce(message AnnounceMessage, ip net.IP, ipv6 net.IP, numWant int) ([]swarmPeer, ScrapeResult, error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if !server.registered(message.InfoHash) {
+		return nil, ScrapeResult{}, errors.New("unregistered torrent")
+	}
+
+	s, ok := server.swarms[message.InfoHash]
+	if !ok {
+		s = &swarm{Peers: make(map[[20]byte]*swarmPeer)}
+		server.swarms[message.InfoHash] = s
+	}
+
+	if ip.To4() == nil || ipv6.To4() != nil {
+		ipv6 = nil
+	}
+
+	// Only a peer we saw downloading counts as a completed download, so
+	// repeated completed events and seeders don't inflate the count.
+	previous, ok := s.Peers[message.PeerID]
+	if message.Event == EventCompleted && ok && previous.Left > 0 {
+		s.Completed += 1
+	}
+
+	if message.Event == EventStopped {
+		delete(s.Peers, message.PeerID)
+	} else {
+		s.Peers[message.PeerID] = &swarmPeer{
+			PeerID:   message.PeerID,
+			IP:       ip,
+			IPv6:     ipv6,
+			Port:     message.Port,
+			Left:     message.Left,
+			LastSeen: time.Now(),
+		}
+	}
+
+	if numWant <= 0 {
+		numWant = serverDefaultNumWant
+	}
+	if numWant > serverMaxNumWant {
+		numWant = serverMaxNumWant
+	}
+
+	// Map iteration order is randomised, which is good enough for handing out
+	// a different subset of the swarm each time.
+	peers := make([]swarmPeer, 0)
+	for peerID, peer := range s.Peers {
+		if len(peers) >= numWant {
+			break
+		}
+
+		// Seeders have no use for other seeders.
+		if peerID == message.PeerID || (message.Left == 0 && peer.Left == 0) {
+			continue
+		}
+
+		peers = append(peers, *peer)
+	}
+
+	return peers, server.stats(s), nil
+}
+
+func (server *TrackerServer) scrape(infoHashes [][20]byte) map[[20]byte]ScrapeResult {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	results := make(map[[20]byte]ScrapeResult)
+
+	// An empty scrape asks for every torrent we know about.
+	if len(infoHashes) == 0 {
+		for infoHash, s := range server.swarms {
+			if server.registered(infoHash) {
+				results[infoHash] = server.stats(s)
+			}
+		}
+
+		return results
+	}
+
+	// Torrents outside the whitelist are left out, as if we'd never heard of
+	// them.
+	for _, infoHash := range infoHashes {
+		if !server.registered(infoHash) {
+			continue
+		}
+
+		if s, ok := server.swarms[infoHash]; ok {
+			results[infoHash] = server.stats(s)
+		} else {
+			results[infoHash] = ScrapeResult{}
+		}
+	}
+
+	return results
+}
+
+// registered reports whether the torrent is on the whitelist, if there is one.
+func (server *TrackerServer) registered(infoHash [20]byte) bool {
+	return server.Whitelist == nil || server.Whitelist[infoHash]
+}
+
+func (server *TrackerServer) stats(s *swarm) ScrapeResult {
+	result := ScrapeResult{Completed: s.Completed}
+
+	for _, peer := range s.Peers {
+		if peer.Left == 0 {
+			result.Seeders += 1
+		} else {
+			result.Leechers += 1
+		}
+	}
+
+	return result
+}
+
+func (server *TrackerServer) HandleAnnounce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	message := AnnounceMessage{}
+	infoHash := q.Get("info_hash")
+	peerID := q.Get("peer_id")
+	if len(infoHash) != 20 || len(peerID) != 20 {
+		writeBencode(w, map[string]any{"failure reason": "invalid info_hash or peer_id"})
+		return
+	}
+	copy(message.InfoHash[:], infoHash)
+	copy(message.PeerID[:], peerID)
+
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		writeBencode(w, map[string]any{"failure reason": "invalid port"})
+		return
+	}
+	message.Port = uint16(port)
+
+	message.Left, _ = strconv.ParseUint(q.Get("left"), 10, 64)
+	message.Uploaded, _ = strconv.ParseUint(q.Get("uploaded"), 10, 64)
+	message.Downloaded, _ = strconv.ParseUint(q.Get("downloaded"), 10, 64)
+
+	for event, name := range eventNames {
+		if q.Get("event") == name {
+			message.Event = event
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		writeBencode(w, map[string]any{"failure reason": "invalid remote address"})
+		return
+	}
+	ip := net.ParseIP(host)
+
+	// The ipv6 parameter may be a bare address or include a port.
+	ipv6 := net.ParseIP(q.Get("ipv6"))
+	if host, _, err := net.SplitHostPort(q.Get("ipv6")); err == nil {
+		ipv6 = net.ParseIP(host)
+	}
+
+	numWant, _ := strconv.Atoi(q.Get("numwant"))
+
+	peers, stats, err := server.announce(message, ip, ipv6, numWant)
+	if err != nil {
+		writeBencode(w, map[string]any{"failure reason": err.Error()})
+		return
+	}
+
+	response := map[string]any{
+		"interval":     int64(server.Interval / time.Second),
+		"min interval": int64(serverMinInterval / time.Second),
+		"complete":     int64(stats.Seeders),
+		"incomplete":   int64(stats.Leechers),
+	}
+
+	if q.Get("compact") == "1" {
+		var peers4, peers6 bytes.Buffer
+
+		for _, peer := range peers {
+			for _, ip := range peer.addresses() {
+				if ip4 := ip.To4(); ip4 != nil {
+					peers4.Write(ip4)
+					binary.Write(&peers4, binary.BigEndian, peer.Port)
+				} else {
+					peers6.Write(ip.To16())
+					binary.Write(&peers6, binary.BigEndian, peer.Port)
+				}
+			}
+		}
+
+		response["peers"] = peers4.String()
+		if peers6.Len() > 0 {
+			response["peers6"] = peers6.String()
+		}
+	} else {
+		peerList := make([]map[string]any, 0, len(peers))
+		for _, peer := range peers {
+			for _, ip := range peer.addresses() {
+				peerList = append(peerList, map[string]any{
+					"peer id": string(peer.PeerID[:]),
+					"ip":      ip.String(),
+					"port":    int64(peer.Port),
+				})
+			}
+		}
+
+		response["peers"] = peerList
+	}
+
+	writeBencode(w, response)
+}
+
+func (server *TrackerServer) HandleScrape(w http.ResponseWriter, r *http.Request) {
+	infoHashes := make([][20]byte, 0)
+	for _, value := range r.URL.Query()["info_hash"] {
+		if len(value) != 20 {
+			continue
+		}
+
+		var infoHash [20]byte
+		copy(infoHash[:], value)
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	files := make(map[string]any)
+	for infoHash, result := range server.scrape(infoHashes) {
+		files[string(infoHash[:])] = map[string]any{
+			"complete":   int64(result.Seeders),
+			"incomplete": int64(result.Leechers),
+			"downloaded": int64(result.Completed),
+		}
+	}
+
+	writeBencode(w, map[string]any{"files": files})
+}
+
+func writeBencode(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	err := bencode.Marshal(w, value)
+	if err != nil {
+		Debugf("Error encoding tracker response: %s", err)
+	}
+}
+
+// connectionID is derived from the client IP and the current minute, so IDs
+// stay valid for one to two minutes without keeping any state. The port is left
+// out as clients may reuse an ID from a different socket.
+func (server *TrackerServer) connectionID(ip net.IP, minute int64) uint64 {
+	var buf bytes.Buffer
+	buf.Write(server.secret[:])
+	buf.Write(ip.To16())
+	binary.Write(&buf, binary.BigEndian, minute)
+
+	hash := sha1.Sum(buf.Bytes())
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+func (server *TrackerServer) validConnectionID(ip net.IP, connectionID uint64) bool {
+	minute := time.Now().Unix() / 60
+
+	return connectionID == server.connectionID(ip, minute) || connectionID == server.connectionID(ip, minute-1)
+}
+
+func (server *TrackerServer) ServeUDP(conn net.PacketConn) {
+	packet := make([]byte, 2048)
+
+	for {
+		numBytes, addr, err := conn.ReadFrom(packet)
+		if err != nil {
+			return
+		}
+
+		resp := server.handleUDP(packet[:numBytes], addr)
+		if resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (server *TrackerServer) handleUDP(packet []byte, addr net.Addr) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := binary.BigEndian.Uint32(packet[12:16])
+
+	resp := make([]byte, 8)
+	binary.BigEndian.PutUint32(resp[4:8], transactionID)
+
+	udpError := func(message string) []byte {
+		binary.BigEndian.PutUint32(resp[0:4], udpActionError)
+		return append(resp, message...)
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+
+		binary.BigEndian.PutUint32(resp[0:4], udpActionConnect)
+		return appendUint64(resp, server.connectionID(udpAddr.IP, time.Now().Unix()/60))
+	}
+
+	if !server.validConnectionID(udpAddr.IP, connectionID) {
+		return udpError("invalid connection id")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		message := AnnounceMessage{}
+		if len(packet) < 98 || binary.Read(bytes.NewReader(packet[:98]), binary.BigEndian, &message) != nil {
+			return udpError("malformed announce")
+		}
+
+		peers, stats, err := server.announce(message, udpAddr.IP, nil, int(int32(message.NumWant)))
+		if err != nil {
+			return udpError(err.Error())
+		}
+
+		binary.BigEndian.PutUint32(resp[0:4], udpActionAnnounce)
+		resp = appendUint32(resp, uint32(server.Interval/time.Second))
+		resp = appendUint32(resp, uint32(stats.Leechers))
+		resp = appendUint32(resp, uint32(stats.Seeders))
+
+		// The address family of the request decides the peer entry size.
+		isIPv4 := udpAddr.IP.To4() != nil
+		for _, peer := range peers {
+			for _, ip := range peer.addresses() {
+				if ip4 := ip.To4(); isIPv4 && ip4 != nil {
+					resp = append(resp, ip4...)
+				} else if !isIPv4 && ip4 == nil {
+					resp = append(resp, ip.To16()...)
+				} else {
+					continue
+				}
+
+				resp = appendUint16(resp, peer.Port)
+			}
+		}
+
+		return resp
+	case udpActionScrape:
+		infoHashes := make([][20]byte, 0)
+		for offset := 16; offset+20 <= len(packet) && len(infoHashes) < udpMaxScrapeHashes; offset += 20 {
+			var infoHash [20]byte
+			copy(infoHash[:], packet[offset:offset+20])
+			infoHashes = append(infoHashes, infoHash)
+		}
+
+		if len(infoHashes) == 0 {
+			return udpError("no info hashes")
+		}
+
+		results := server.scrape(infoHashes)
+
+		binary.BigEndian.PutUint32(resp[0:4], udpActionScrape)
+		for _, infoHash := range infoHashes {
+			result := results[infoHash]
+			resp = appendUint32(resp, uint32(result.Seeders))
+			resp = appendUint32(resp, uint32(result.Completed))
+			resp = appendUint32(resp, uint32(result.Leechers))
+		}
+
+		return resp
+	}
+
+	return udpError("unknown action")
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
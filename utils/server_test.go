@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+var (
+	testServerInfoHash = [20]byte{1}
+	testServerOther    = [20]byte{2}
+)
+
+// testServerAnnounce announces to the tracker from the given address and
+// decodes the reply as our client does.
+func testServerAnnounce(t *testing.T, server *TrackerServer, remoteAddr string, params url.Values) *BencodeAnnounce {
+	query := url.Values{"info_hash": {string(testServerInfoHash[:])}, "port": {"6881"}, "left": {"100"}}
+	for key, values := range params {
+		query[key] = values
+	}
+
+	request := httptest.NewRequest("GET", "/announce?"+query.Encode(), nil)
+	request.RemoteAddr = remoteAddr
+	recorder := httptest.NewRecorder()
+	server.HandleAnnounce(recorder, request)
+
+	announce, err := Announce(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return announce
+}
+
+func testPeerID(id byte) string {
+	peerID := [20]byte{id}
+	return string(peerID[:])
+}
+
+func TestTrackerServerAnnounce(t *testing.T) {
+	server := NewTrackerServer()
+
+	// A peer reached over IPv4 that also has an IPv6 address (BEP 7).
+	testServerAnnounce(t, server, "192.0.2.1:50000", url.Values{"peer_id": {testPeerID(1)}, "ipv6": {"[2001:db8::1]:6881"}})
+
+	compact := testServerAnnounce(t, server, "192.0.2.2:50000", url.Values{"peer_id": {testPeerID(2)}, "compact": {"1"}})
+	if compact.Incomplete != 2 || compact.Complete != 0 {
+		t.Errorf("%d leechers and %d seeders, want 2 and 0", compact.Incomplete, compact.Complete)
+	}
+
+	peers := ParsePeers([]byte(compact.CompactPeers))
+	peers6 := ParsePeers6([]byte(compact.CompactPeers6))
+	if len(peers) != 1 || !peers[0].IP.Equal(net.ParseIP("192.0.2.1")) || peers[0].Port != 6881 {
+		t.Errorf("compact IPv4 peers %v", peers)
+	}
+	if len(peers6) != 1 || !peers6[0].IP.Equal(net.ParseIP("2001:db8::1")) || peers6[0].Port != 6881 {
+		t.Errorf("compact IPv6 peers %v", peers6)
+	}
+
+	dictionary := testServerAnnounce(t, server, "192.0.2.3:50000", url.Values{"peer_id": {testPeerID(3)}})
+	addresses := make(map[string]bool)
+	for _, peer := range dictionary.Peers {
+		addresses[net.JoinHostPort(peer.IP, "6881")] = peer.Port == 6881
+	}
+	for _, address := range []string{"192.0.2.1:6881", "[2001:db8::1]:6881", "192.0.2.2:6881"} {
+		if !addresses[address] {
+			t.Errorf("dictionary peers %v are missing %s", dictionary.Peers, address)
+		}
+	}
+
+	// A seeder isn't sent to other seeders.
+	testServerAnnounce(t, server, "192.0.2.1:50000", url.Values{"peer_id": {testPeerID(1)}, "left": {"0"}, "event": {"completed"}})
+	seeder := testServerAnnounce(t, server, "192.0.2.4:50000", url.Values{"peer_id": {testPeerID(4)}, "left": {"0"}, "compact": {"1"}})
+	if peers := ParsePeers([]byte(seeder.CompactPeers)); len(peers) != 2 {
+		t.Errorf("seeder got %d peers, want the 2 leechers", len(peers))
+	}
+
+	// Only the leecher that finished counts as a completed download, not a
+	// repeated event or a peer that started out seeding.
+	testServerAnnounce(t, server, "192.0.2.1:50000", url.Values{"peer_id": {testPeerID(1)}, "left": {"0"}, "event": {"completed"}})
+	testServerAnnounce(t, server, "192.0.2.5:50000", url.Values{"peer_id": {testPeerID(5)}, "left": {"0"}, "event": {"completed"}})
+	if result := server.stats(server.swarms[testServerInfoHash]); result.Completed != 1 {
+		t.Errorf("%d completed downloads, want 1", result.Completed)
+	}
+}
+
+func TestTrackerServerWhitelist(t *testing.T) {
+	server := NewTrackerServer()
+	server.Whitelist = map[[20]byte]bool{testServerInfoHash: true}
+	testServerAnnounce(t, server, "192.0.2.1:50000", url.Values{"peer_id": {testPeerID(1)}})
+
+	rejected := testServerAnnounce(t, server, "192.0.2.1:50000", url.Values{"peer_id": {testPeerID(1)}, "info_hash": {string(testServerOther[:])}})
+	if rejected.FailureReason != "unregistered torrent" {
+		t.Errorf("announce for an unregistered torrent got failure %q", rejected.FailureReason)
+	}
+
+	// HTTP scrapes leave out torrents that aren't on the whitelist.
+	query := url.Values{"info_hash": {string(testServerInfoHash[:]), string(testServerOther[:])}}
+	recorder := httptest.NewRecorder()
+	server.HandleScrape(recorder, httptest.NewRequest("GET", "/scrape?"+query.Encode(), nil))
+
+	decoded, err := bencode.Decode(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := decoded.(map[string]any)["files"].(map[string]any)
+	file, _ := files[string(testServerInfoHash[:])].(map[string]any)
+	if len(files) != 1 || bencodeInt(file["incomplete"]) != 1 {
+		t.Errorf("scraped %v, want only the whitelisted torrent", files)
+	}
+
+	// UDP scrapes answer with zeros for them.
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}
+	packet := appendUint64(nil, server.connectionID(addr.IP, time.Now().Unix()/60))
+	packet = appendUint32(packet, udpActionScrape)
+	packet = appendUint32(packet, 1)
+	packet = append(packet, testServerOther[:]...)
+	packet = append(packet, testServerInfoHash[:]...)
+
+	resp := server.handleUDP(packet, addr)
+	if len(resp) != 8+24 || binary.BigEndian.Uint32(resp[0:4]) != udpActionScrape {
+		t.Fatalf("invalid UDP scrape response %x", resp)
+	}
+	if leechers := binary.BigEndian.Uint32(resp[16:20]); leechers != 0 {
+		t.Errorf("UDP scrape reports %d leechers for an unregistered torrent", leechers)
+	}
+	if leechers := binary.BigEndian.Uint32(resp[28:32]); leechers != 1 {
+		t.Errorf("UDP scrape reports %d leechers for the whitelisted torrent, want 1", leechers)
+	}
+}
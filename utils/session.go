@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	handshakeTimeout = 3 * time.Second
+	requestTimeout   = 10 * time.Second
+
+	// Peers send keep-alives every two minutes or so when idle.
+	peerIdleTimeout = 3 * time.Minute
+
+	maxRequestLength = 1 << 17
+
+	// allowedFastCount is how many pieces peers may request while we choke
+	// them.
+	allowedFastCount = 10
+)
+
+var errPeerClosed = errors.New("peer connection closed")
+
+// peerSession is what the goroutines reading from, downloading from and
+// choking a connected peer share.
+type peerSession struct {
+	lock      sync.Mutex
+	writeLock sync.Mutex
+	lastWrite time.Time
+
+	// events passes pieces, rejects and choke changes from the read loop to
+	// GetPiece.
+	events    chan Message
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// interested is the peer's interest in our pieces, and unchoking whether
+	// we let it request them.
+	interested bool
+	unchoking  bool
+
+	// grantedFast holds the pieces we let the peer request while we choke it.
+	grantedFast map[int]bool
+
+	// Byte counts for the connection, and rates over the last choke round.
+	downloaded     int64
+	uploaded       int64
+	lastDownloaded int64
+	lastUploaded   int64
+	downloadRate   float64
+	uploadRate     float64
+}
+
+func newPeerSession(torrent TorrentFile) *peerSession {
+	return &peerSession{
+		events: make(chan Message, torrent.PieceLength/16384+16),
+		done:   make(chan struct{}),
+	}
+}
+
+func (peer *Peer) Close() {
+	peer.session.closeOnce.Do(func() {
+		close(peer.session.done)
+		peer.Connection.Close()
+	})
+}
+
+func (peer *Peer) Closed() bool {
+	select {
+	case <-peer.session.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// setUnchoking chokes or unchokes the peer, if that changes anything.
+func (peer *Peer) setUnchoking(unchoking bool) {
+	peer.session.lock.Lock()
+	changed := peer.session.unchoking != unchoking
+	peer.session.unchoking = unchoking
+	peer.session.lock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if unchoking {
+		peer.SendMessage(Message{ID: MsgUnchoke})
+	} else {
+		peer.SendMessage(Message{ID: MsgChoke})
+	}
+}
+
+// readLoop handles everything the peer sends until the connection drops,
+// serving its requests and handing piece data to GetPiece.
+func (download *Download) readLoop(peer *Peer) {
+	defer download.unregister(peer)
+	defer peer.Close()
+
+	for {
+		message, err := peer.readMessage(peerIdleTimeout)
+		if err != nil {
+			Debugf("Disconnecting from %s: %s", peer, err)
+			return
+		}
+
+		switch message.ID {
+		case MsgPiece, MsgReject, MsgChoke, MsgUnchoke:
+			if message.ID == MsgPiece && len(message.Payload) > 8 {
+				peer.session.lock.Lock()
+				peer.session.downloaded += int64(len(message.Payload) - 8)
+				peer.session.lock.Unlock()
+			}
+
+			// Nothing is waiting for these if no piece is being downloaded.
+			select {
+			case peer.session.events <- message:
+			default:
+			}
+		case MsgHave:
+			if download.SuperSeed.Active() {
+				index, _ := message.Index()
+				download.SuperSeed.sawPiece(peer, index)
+			}
+		case MsgInterested, MsgUninterested:
+			peer.session.lock.Lock()
+			peer.session.interested = message.ID == MsgInterested
+			peer.session.lock.Unlock()
+
+			if download.Choker != nil {
+				download.Choker.Wake()
+			}
+		case MsgRequest:
+			err := download.serveRequest(peer, message)
+			if err != nil {
+				Debugf("Disconnecting from %s: %s", peer, err)
+				return
+			}
+		}
+	}
+}
+
+// serveRequest uploads a block if we have it and the peer is unchoked or the
+// piece is in its allowed fast set. Peers with the Fast Extension are told
+// about requests we won't serve.
+func (download *Download) serveRequest(peer *Peer, message Message) error {
+	if len(message.Payload) != 12 {
+		return errors.New("invalid request message")
+	}
+
+	index := int(binary.BigEndian.Uint32(message.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(message.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(message.Payload[8:12]))
+
+	peer.session.lock.Lock()
+	allowed := peer.session.unchoking || peer.session.grantedFast[index]
+	peer.session.lock.Unlock()
+
+	valid := index < download.Torrent.NumPieces() && length <= maxRequestLength && begin+length <= download.Torrent.PieceSize(index)
+	if !allowed || !valid || !download.HasPiece(index) {
+		if peer.Fast {
+			return peer.SendMessage(Message{ID: MsgReject, Payload: message.Payload})
+		}
+		return nil
+	}
+
+	payload := make([]byte, 8+length)
+	copy(payload, message.Payload[0:8])
+
+	err := download.Storage.ReadAt(index, begin, payload[8:])
+	if err != nil {
+		Debugf("Error reading piece %d for %s: %s", index, peer, err)
+		return nil
+	}
+
+	err = peer.SendMessage(Message{ID: MsgPiece, Payload: payload})
+	if err != nil {
+		return err
+	}
+
+	peer.session.lock.Lock()
+	peer.session.uploaded += int64(length)
+	peer.session.lock.Unlock()
+
+	download.lock.Lock()
+	download.Uploaded += int64(length)
+	download.lock.Unlock()
+
+	return nil
+}
+
+func (download *Download) HasPiece(index int) bool {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	return download.Have.HasPiece(index)
+}
+
+func (download *Download) register(peer *Peer) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	download.peers[peer] = struct{}{}
+}
+
+func (download *Download) unregister(peer *Peer) {
+	download.lock.Lock()
+	delete(download.peers, peer)
+	download.lock.Unlock()
+
+	download.SuperSeed.forget(peer)
+}
+
+// Peers returns the peers we are connected to.
+func (download *Download) Peers() []*Peer {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	peers := make([]*Peer, 0, len(download.peers))
+	for peer := range download.peers {
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// broadcast sends a message to every connected peer. Slow peers hold up the
+// rest, so callers run it in its own goroutine.
+func (download *Download) broadcast(message Message) {
+	for _, peer := range download.Peers() {
+		peer.SendMessage(message)
+	}
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CheckFreeSpace fails if the filesystem the download is stored on doesn't have
+// room for the parts of the torrent that aren't on disk yet. If the download is
+// moved to another filesystem once complete, that one needs room for all of it.
+func (download *Download) CheckFreeSpace() error {
+	disk, ok := asDiskStorage(download.Storage)
+	if !ok {
+		return nil
+	}
+
+	needed, total := int64(0), int64(0)
+	for _, fileRange := range download.Torrent.FileRanges(0, download.Torrent.Length) {
+		if fileRange.Padding {
+			continue
+		}
+		total += int64(fileRange.Length)
+
+		// Files may already have their full size without the space to back it,
+		// when memory-mapped or sparsely preallocated, so count what is really
+		// allocated.
+		size := int64(0)
+		if info, err := os.Stat(disk.FilePath(fileRange.Path)); err == nil {
+			size = allocatedSize(info)
+		}
+
+		if size < int64(fileRange.Length) {
+			needed += int64(fileRange.Length) - size
+		}
+	}
+
+	dir := existingDir(disk.FilePath(nil))
+	err := checkSpace(dir, needed)
+	if err != nil || len(download.SavePath) == 0 {
+		return err
+	}
+
+	saveDir := existingDir(download.SavePath)
+	if sameFilesystem(dir, saveDir) {
+		return nil
+	}
+
+	return checkSpace(saveDir, total)
+}
+
+// existingDir is the closest directory to dir that exists, as download
+// directories may not have been created yet.
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func checkSpace(dir string, needed int64) error {
+	available, err := freeSpace(dir)
+	if errors.Is(err, errFreeSpaceUnsupported) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if needed > available {
+		return fmt.Errorf("not enough free space in %s: need %d bytes, %d available", dir, needed, available)
+	}
+
+	return nil
+}
+
+// Preallocate reserves disk space for every file up front. "sparse" only sets
+// file sizes, "full" allocates blocks so writes can't fail with ENOSPC later,
+// and "none" leaves files to grow as pieces arrive.
+func (download *Download) Preallocate(mode string) error {
+	disk, ok := asDiskStorage(download.Storage)
+	if !ok {
+		return nil
+	}
+
+	switch mode {
+	case "", "none":
+		return nil
+	case "sparse", "full":
+	default:
+		return fmt.Errorf("unknown preallocation mode %q", mode)
+	}
+
+	for _, fileRange := range download.Torrent.FileRanges(0, download.Torrent.Length) {
+		if fileRange.Padding || fileRange.Length == 0 {
+			continue
+		}
+
+		err := preallocateFile(disk.FilePath(fileRange.Path), int64(fileRange.Length), mode == "full")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func preallocateFile(path string, length int64, full bool) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if full {
+		return allocate(file, info.Size(), length)
+	}
+
+	if info.Size() < length {
+		return file.Truncate(length)
+	}
+
+	return nil
+}
+
+var errFreeSpaceUnsupported = errors.New("free space check not supported on this platform")
+
+// fillZeros allocates blocks by writing zeros past the end of a file, for
+// filesystems without fallocate.
+func fillZeros(file *os.File, size int64, length int64) error {
+	zeros := make([]byte, 1<<20)
+
+	for offset := size; offset < length; offset += int64(len(zeros)) {
+		chunk := zeros
+		if length-offset < int64(len(chunk)) {
+			chunk = chunk[:length-offset]
+		}
+
+		_, err := file.WriteAt(chunk, offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckFreeSpaceSavePath(t *testing.T) {
+	// The save path needs a second, smaller filesystem.
+	savePath, err := os.MkdirTemp("/dev/shm", "save")
+	if err != nil {
+		t.Skip("no /dev/shm to save to")
+	}
+	defer os.RemoveAll(savePath)
+
+	incomplete := t.TempDir()
+	if sameFilesystem(incomplete, savePath) {
+		t.Skip("/dev/shm is on the same filesystem as the temporary directory")
+	}
+
+	saveSpace, err := freeSpace(savePath)
+	if err != nil {
+		t.Skip(err)
+	}
+	incompleteSpace, err := freeSpace(incomplete)
+	if err != nil || incompleteSpace <= saveSpace {
+		t.Skip("the temporary directory has no more room than /dev/shm")
+	}
+
+	// Fits where it is downloaded, but not where it is moved to.
+	pieceLength := 1 << 30
+	length := int(saveSpace) + 1
+	torrent := TorrentFile{Name: "large", PieceLength: pieceLength, Length: length, PieceHash: make([][20]byte, 1+(length-1)/pieceLength)}
+
+	download := &Download{Torrent: torrent, Storage: NewFileStorage(torrent, incomplete, ".part"), SavePath: savePath}
+	if err := download.CheckFreeSpace(); err == nil || !strings.Contains(err.Error(), savePath) {
+		t.Errorf("got error %v, want the save path to be short of space", err)
+	}
+
+	download.SavePath = incomplete
+	if err := download.CheckFreeSpace(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,48 @@
+package utils
+
+type Status struct {
+	CompletedPieces    int
+	TotalPieces        int
+	ConnectedCountries []string
+	BannedPeers        []string
+	FailedFiles        []string
+	Moving             bool
+	Moved              int64
+	MoveSize           int64
+	Swarm              ScrapeResult
+	Hashing            HashStats
+	Cache              CacheStats
+}
+
+func (download *Download) Status() Status {
+	// The pool and the cache have their own locks, which are held during disk
+	// writes, so they are read before taking ours.
+	hashing := download.Hashes.Stats()
+
+	var cache CacheStats
+	if storage, ok := download.Storage.(*CachedStorage); ok {
+		cache = storage.Stats()
+	}
+
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	countries := make([]string, len(download.ConnectedCountries))
+	copy(countries, download.ConnectedCountries)
+
+	status := Status{
+		CompletedPieces:    download.CompletedPieces,
+		TotalPieces:        download.Torrent.NumPieces(),
+		ConnectedCountries: countries,
+		BannedPeers:        download.Bans.Banned(),
+		FailedFiles:        append([]string(nil), download.FailedFiles...),
+		Moving:             download.moving,
+		Moved:              download.moved,
+		MoveSize:           download.moveSize,
+		Swarm:              download.Swarm,
+		Hashing:            hashing,
+		Cache:              cache,
+	}
+
+	return status
+}
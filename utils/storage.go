@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Storage is where a download keeps its data. Offsets are relative to the
+// start of a piece, and implementations map them onto the torrent's files.
+type Storage interface {
+	ReadAt(index int, begin int, data []byte) error
+	WriteAt(index int, begin int, data []byte) error
+	Flush() error
+	Close() error
+	Stat() (StorageStat, error)
+}
+
+// StorageStat describes how much of the torrent a storage currently holds.
+type StorageStat struct {
+	Files int
+	Bytes int64
+}
+
+// diskStorage is implemented by storages that keep the torrent's files on disk,
+// so they can be linked, hidden or made executable, and moved once complete.
+type diskStorage interface {
+	FilePath(path []string) string
+	Move(root string, progress func(moved int64, total int64)) error
+}
+
+// asDiskStorage looks through a cache to the storage underneath it.
+func asDiskStorage(storage Storage) (diskStorage, bool) {
+	if cache, ok := storage.(*CachedStorage); ok {
+		storage = cache.Backend
+	}
+
+	disk, ok := storage.(diskStorage)
+	return disk, ok
+}
+
+// HasStoredData reports whether any of the torrent's data is under root with
+// its final file names, such as from an earlier download.
+func HasStoredData(torrent TorrentFile, root string) bool {
+	stat, err := statFiles(torrent, func(path []string) string {
+		return storagePath(root, path, "")
+	})
+
+	return err == nil && stat.Bytes > 0
+}
+
+// NewStorage opens a storage of the given kind under root. For disk storages,
+// suffix is appended to every file name until the download is moved.
+func NewStorage(kind string, torrent TorrentFile, root string, suffix string) (Storage, error) {
+	switch kind {
+	case "", "file":
+		return NewFileStorage(torrent, root, suffix), nil
+	case "mmap":
+		storage, err := NewMmapStorage(torrent, root, suffix)
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	case "memory":
+		return NewMemoryStorage(torrent), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", kind)
+	}
+}
+
+// storageRanges maps a span of a piece onto the files it covers, leaving out
+// padding files which are never stored.
+func storageRanges(torrent TorrentFile, index int, begin int, length int) []FileRange {
+	fileRanges := make([]FileRange, 0)
+
+	for _, fileRange := range torrent.FileRanges(index*torrent.PieceLength+begin, length) {
+		if !fileRange.Padding {
+			fileRanges = append(fileRanges, fileRange)
+		}
+	}
+
+	return fileRanges
+}
+
+func storagePath(root string, path []string, suffix string) string {
+	segments := SafePath(path)
+	if len(segments) == 0 {
+		return root
+	}
+
+	return filepath.Join(append([]string{root}, segments...)...) + suffix
+}
+
+// storedPaths lists the paths of every file a storage keeps, including empty
+// files and symlinks, each starting with the torrent name.
+func storedPaths(torrent TorrentFile) [][]string {
+	if len(torrent.Files) == 0 {
+		return [][]string{{torrent.Name}}
+	}
+
+	paths := make([][]string, 0, len(torrent.Files))
+	for _, file := range torrent.Files {
+		if !file.Padding {
+			paths = append(paths, append([]string{torrent.Name}, file.Path...))
+		}
+	}
+
+	return paths
+}
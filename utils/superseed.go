@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// SuperSeeder keeps a seed from uploading the same piece more than it has to
+// (BEP 16). Peers are told we have nothing, then offered one rare piece each
+// with a have message, and only offered another once the first shows up at
+// some other peer, meaning they passed it on.
+type SuperSeeder struct {
+	download *Download
+
+	// offered is the piece each peer was last offered, and offers how many
+	// connected peers each piece is currently offered to.
+	offered map[*Peer]int
+	offers  map[int]int
+	lock    sync.Mutex
+}
+
+func (download *Download) StartSuperSeeding() {
+	download.SuperSeed = &SuperSeeder{
+		download: download,
+		offered:  make(map[*Peer]int),
+		offers:   make(map[int]int),
+	}
+}
+
+// Active reports whether we are super-seeding, which only starts once the
+// download is complete.
+func (seeder *SuperSeeder) Active() bool {
+	return seeder != nil && seeder.download.Complete()
+}
+
+// offer reveals the rarest piece the peer doesn't have yet.
+func (seeder *SuperSeeder) offer(peer *Peer) {
+	seeder.lock.Lock()
+
+	peers := seeder.download.Peers()
+	best, bestCount, ties := -1, 0, 0
+	for i := 0; i < seeder.download.Torrent.NumPieces(); i++ {
+		if peer.HasPiece(i) {
+			continue
+		}
+
+		count := seeder.offers[i]
+		for _, other := range peers {
+			if other.HasPiece(i) {
+				count += 1
+			}
+		}
+
+		// Break ties at random so peers joining together get different pieces.
+		if best < 0 || count < bestCount {
+			best, bestCount, ties = i, count, 1
+		} else if count == bestCount {
+			ties += 1
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+
+	seeder.withdraw(peer)
+
+	if best < 0 {
+		seeder.lock.Unlock()
+		return
+	}
+
+	seeder.offered[peer] = best
+	seeder.offers[best] += 1
+	seeder.lock.Unlock()
+
+	Debugf("Super-seeding piece %d to %s", best, peer)
+	peer.SendMessage(Message{ID: MsgHave, Payload: appendUint32(nil, uint32(best))})
+}
+
+// sawPiece is called when a peer announces it has a piece. Peers that were
+// offered that piece get a new one if it reached someone else, or if the peer
+// that downloaded it has nobody left to pass it on to.
+func (seeder *SuperSeeder) sawPiece(from *Peer, index int) {
+	seeder.lock.Lock()
+
+	next := make([]*Peer, 0)
+	for peer, offered := range seeder.offered {
+		if offered != index {
+			continue
+		}
+
+		if peer != from || !seeder.othersNeed(peer, index) {
+			next = append(next, peer)
+		}
+	}
+
+	seeder.lock.Unlock()
+
+	for _, peer := range next {
+		seeder.offer(peer)
+	}
+}
+
+func (seeder *SuperSeeder) othersNeed(peer *Peer, index int) bool {
+	for _, other := range seeder.download.Peers() {
+		if other != peer && !other.HasPiece(index) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (seeder *SuperSeeder) forget(peer *Peer) {
+	if seeder == nil {
+		return
+	}
+
+	seeder.lock.Lock()
+	defer seeder.lock.Unlock()
+
+	seeder.withdraw(peer)
+}
+
+// withdraw drops the peer's current offer, if it has one.
+func (seeder *SuperSeeder) withdraw(peer *Peer) {
+	if index, ok := seeder.offered[peer]; ok {
+		seeder.offers[index] -= 1
+		delete(seeder.offered, peer)
+	}
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// testSuperSeedPeer is a peer with no pieces whose messages are discarded.
+func testSuperSeedPeer(t *testing.T, torrent TorrentFile) *Peer {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	go io.Copy(io.Discard, remote)
+
+	return &Peer{Connection: local, Bitfield: CreateBitfield(torrent.NumPieces()), session: newPeerSession(torrent)}
+}
+
+func TestSuperSeedWithdrawsOffers(t *testing.T) {
+	torrent := checkTorrent(make([]byte, 64), 16)
+	download := &Download{Torrent: torrent, peers: make(map[*Peer]struct{})}
+	download.StartSuperSeeding()
+	seeder := download.SuperSeed
+
+	outstanding := func() int {
+		seeder.lock.Lock()
+		defer seeder.lock.Unlock()
+
+		total := 0
+		for _, count := range seeder.offers {
+			total += count
+		}
+		return total
+	}
+
+	first, second := testSuperSeedPeer(t, torrent), testSuperSeedPeer(t, torrent)
+	seeder.offer(first)
+	seeder.offer(second)
+
+	// A new offer replaces the peer's last one.
+	seeder.offer(first)
+	if count := outstanding(); count != 2 {
+		t.Errorf("%d outstanding offers for 2 peers", count)
+	}
+
+	seeder.forget(first)
+	seeder.forget(second)
+	if count := outstanding(); count != 0 {
+		t.Errorf("%d outstanding offers after the peers left", count)
+	}
+}
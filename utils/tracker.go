@@ -3,7 +3,7 @@ package utils
 import (
 	"encoding/binary"
 	"errors"
-	"math/rand"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
@@ -11,13 +11,24 @@ import (
 )
 
 type Tracker struct {
-	AnnounceURL *url.URL
+	AnnounceURL        *url.URL
+	Started            bool
+	TrackerID          string
+	connectionID       uint64
+	connectionIDExpiry time.Time
+
+	// Cancel interrupts UDP requests waiting on the tracker when closed.
+	Cancel <-chan struct{}
+
+	// Budget, if set, limits the time UDP requests wait on the tracker in
+	// all, cutting the retransmission schedule short.
+	Budget time.Duration
 }
 
 func ParsePeers(peersBytes []byte) []Peer {
 	peers := make([]Peer, 0)
 
-	for offset := 0; offset < len(peersBytes); offset += 6 {
+	for offset := 0; offset+6 <= len(peersBytes); offset += 6 {
 		peer := Peer{
 			IP:   net.IP(peersBytes[offset : offset+4]),
 			Port: binary.BigEndian.Uint16(peersBytes[offset+4 : offset+6]),
@@ -29,62 +40,43 @@ func ParsePeers(peersBytes []byte) []Peer {
 	return peers
 }
 
-func (tracker *Tracker) AnnounceUDP(torrent TorrentFile) ([]Peer, error) {
-	conn, err := net.DialTimeout("udp", tracker.AnnounceURL.Host, time.Second*2)
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-
-	transactionID := rand.Uint32()
-	connectPacket := make([]byte, 16)
-	binary.BigEndian.PutUint64(connectPacket[0:8], 0x41727101980)   // Bittorent protocol ID
-	binary.BigEndian.PutUint32(connectPacket[8:12], 0)              // action = 0 (connect)
-	binary.BigEndian.PutUint32(connectPacket[12:16], transactionID) // random transaction ID
-
-	conn.Write(connectPacket)
+// ParsePeers6 parses the 18-byte compact IPv6 peer format from BEP 7.
+func ParsePeers6(peersBytes []byte) []Peer {
+	peers := make([]Peer, 0)
 
-	resp := make([]byte, 2048)
-	conn.SetReadDeadline(time.Now().Add(time.Second))
-	_, err = conn.Read(resp)
+	for offset := 0; offset+18 <= len(peersBytes); offset += 18 {
+		peer := Peer{
+			IP:   net.IP(peersBytes[offset : offset+16]),
+			Port: binary.BigEndian.Uint16(peersBytes[offset+16 : offset+18]),
+		}
 
-	if err != nil {
-		return nil, err
+		peers = append(peers, peer)
 	}
 
-	action := binary.BigEndian.Uint32(resp[0:4])
-	respTransactionID := binary.BigEndian.Uint32(resp[4:8])
-	connectionID := binary.BigEndian.Uint64(resp[8:16])
+	return peers
+}
 
-	if action != 0 || transactionID != respTransactionID {
-		return nil, errors.New("invalid UDP connect response")
+func (tracker *Tracker) AnnounceTCP(announceMessage AnnounceMessage) (*AnnounceResponse, error) {
+	announceURL := *tracker.AnnounceURL
+	announceURL.RawQuery = announceMessage.ToQueryParams()
+	if len(tracker.TrackerID) > 0 {
+		announceURL.RawQuery += "&" + url.Values{"trackerid": {tracker.TrackerID}}.Encode()
 	}
 
-	announceMessage := GenerateAnnounceMessage(torrent)
-	announceMessage.ConnectionID = connectionID
-	announceMessage.TransactionID = transactionID
-
-	announcePacket := announceMessage.ToBytes()
-	conn.Write(announcePacket)
-	resp = make([]byte, 2048)
-	numBytes, _ := conn.Read(resp)
-
-	action = binary.BigEndian.Uint32(resp[0:4])
-	respTransactionID = binary.BigEndian.Uint32(resp[4:8])
-
-	if action != 1 || transactionID != respTransactionID {
-		return nil, errors.New("invalid UDP announce response")
+	// The tracker only sees the address we connect from, so give it our IPv6
+	// one too for peers that can only reach us over IPv6 (BEP 7).
+	if ip := publicIPv6(); ip != nil {
+		announceURL.RawQuery += "&" + url.Values{"ipv6": {ip.String()}}.Encode()
 	}
 
-	return ParsePeers(resp[20:numBytes]), nil
-}
-
-func (tracker Tracker) AnnounceTCP(torrent TorrentFile) ([]Peer, error) {
-	tracker.AnnounceURL.RawQuery = GenerateAnnounceMessage(torrent).ToQueryParams()
+	// Keep any query the tracker's announce URL already carries (often a passkey).
+	if len(tracker.AnnounceURL.RawQuery) > 0 {
+		announceURL.RawQuery = tracker.AnnounceURL.RawQuery + "&" + announceURL.RawQuery
+	}
 	client := http.Client{
 		Timeout: 1 * time.Second,
 	}
-	httpResp, err := client.Get(tracker.AnnounceURL.String())
+	httpResp, err := client.Get(announceURL.String())
 	if err != nil {
 		return nil, err
 	}
@@ -96,22 +88,64 @@ func (tracker Tracker) AnnounceTCP(torrent TorrentFile) ([]Peer, error) {
 		return nil, err
 	}
 
-	peers := make([]Peer, 0)
+	if len(announceResponse.FailureReason) > 0 {
+		return nil, fmt.Errorf("tracker failure: %s", announceResponse.FailureReason)
+	}
+
+	if len(announceResponse.WarningMessage) > 0 {
+		Debugf("Warning from tracker %s: %s", tracker.AnnounceURL, announceResponse.WarningMessage)
+	}
+
+	if len(announceResponse.TrackerID) > 0 {
+		tracker.TrackerID = announceResponse.TrackerID
+	}
+
+	peers := ParsePeers([]byte(announceResponse.CompactPeers))
+	peers = append(peers, ParsePeers6([]byte(announceResponse.CompactPeers6))...)
 	for _, peer := range announceResponse.Peers {
-		peers = append(peers, Peer{IP: net.ParseIP(peer.IP), Port: uint16(peer.Port)})
+		ip := net.ParseIP(peer.IP)
+		if ip == nil {
+			continue
+		}
+
+		peers = append(peers, Peer{IP: ip, Port: uint16(peer.Port)})
 	}
 
-	return peers, nil
+	return &AnnounceResponse{
+		Peers:       peers,
+		Interval:    time.Duration(announceResponse.Interval) * time.Second,
+		MinInterval: time.Duration(announceResponse.MinInterval) * time.Second,
+		Seeders:     announceResponse.Complete,
+		Leechers:    announceResponse.Incomplete,
+	}, nil
 }
 
-func (tracker Tracker) Announce(torrent TorrentFile) ([]Peer, error) {
+func (tracker *Tracker) Announce(announceMessage AnnounceMessage) (*AnnounceResponse, error) {
 	if tracker.AnnounceURL.Scheme == "udp" {
-		return tracker.AnnounceUDP(torrent)
+		return tracker.AnnounceUDP(announceMessage)
 	}
 
 	if tracker.AnnounceURL.Scheme == "https" || tracker.AnnounceURL.Scheme == "http" {
-		return tracker.AnnounceTCP(torrent)
+		return tracker.AnnounceTCP(announceMessage)
 	}
 
 	return nil, errors.New("unsupported url scheme")
 }
+
+// publicIPv6 returns a globally routable IPv6 address of this host, if it has
+// one.
+func publicIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() && !ipNet.IP.IsPrivate() {
+			return ipNet.IP
+		}
+	}
+
+	return nil
+}
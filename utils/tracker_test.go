@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePeers(t *testing.T) {
+	peers := ParsePeers([]byte{192, 0, 2, 1, 0x1a, 0xe1, 10, 0, 0, 1, 0, 80, 1})
+	if len(peers) != 2 || !peers[0].IP.Equal(net.IPv4(192, 0, 2, 1)) || peers[0].Port != 6881 || peers[1].Port != 80 {
+		t.Errorf("parsed %v", peers)
+	}
+
+	compact6 := append(net.ParseIP("2001:db8::1"), 0x1a, 0xe1)
+	peers = ParsePeers6(compact6)
+	if len(peers) != 1 || !peers[0].IP.Equal(net.ParseIP("2001:db8::1")) || peers[0].Port != 6881 {
+		t.Errorf("parsed %v", peers)
+	}
+}
+
+func TestAnnounceDecoding(t *testing.T) {
+	compact := "d8:completei3e10:incompletei4e8:intervali1800e5:peers6:\xc0\x00\x02\x01\x1a\xe16:peers618:" +
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e"
+
+	announce, err := Announce(strings.NewReader(compact))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if announce.Complete != 3 || announce.Incomplete != 4 || announce.Interval != 1800 {
+		t.Errorf("decoded %+v", announce)
+	}
+	if len(announce.CompactPeers) != 6 || len(announce.CompactPeers6) != 18 {
+		t.Errorf("compact peers of %d and %d bytes, want 6 and 18", len(announce.CompactPeers), len(announce.CompactPeers6))
+	}
+
+	dictionary := "d8:intervali900e5:peersld2:ip9:192.0.2.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881eed2:ip11:2001:db8::14:porti6882eeee"
+
+	announce, err = Announce(strings.NewReader(dictionary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(announce.Peers) != 2 || announce.Peers[0].IP != "192.0.2.1" || announce.Peers[1].Port != 6882 || len(announce.CompactPeers) != 0 {
+		t.Errorf("decoded %+v", announce)
+	}
+}
+
+func TestAnnounceTCP(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte("d8:intervali900e12:min intervali60e10:tracker id3:abc5:peers6:\xc0\x00\x02\x01\x1a\xe1" +
+			"6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+
+	announceURL, _ := url.Parse(server.URL + "/announce?passkey=secret")
+	tracker := &Tracker{AnnounceURL: announceURL}
+
+	resp, err := tracker.Announce(AnnounceMessage{Port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if query.Get("passkey") != "secret" || query.Get("compact") != "1" {
+		t.Errorf("announced with query %v", query)
+	}
+	if len(resp.Peers) != 2 || !resp.Peers[0].IP.Equal(net.IPv4(192, 0, 2, 1)) || !resp.Peers[1].IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("got peers %v", resp.Peers)
+	}
+	if resp.Interval != 900*time.Second || resp.MinInterval != time.Minute || tracker.TrackerID != "abc" {
+		t.Errorf("got interval %s, min interval %s and tracker ID %q", resp.Interval, resp.MinInterval, tracker.TrackerID)
+	}
+
+	// The tracker ID is sent back on the next announce.
+	if _, err := tracker.Announce(AnnounceMessage{Port: 6881}); err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("trackerid") != "abc" {
+		t.Errorf("announced with tracker ID %q, want abc", query.Get("trackerid"))
+	}
+}
+
+func TestAnnounceTCPFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason20:unregistered torrente"))
+	}))
+	defer server.Close()
+
+	announceURL, _ := url.Parse(server.URL + "/announce")
+	tracker := &Tracker{AnnounceURL: announceURL}
+
+	_, err := tracker.Announce(AnnounceMessage{Port: 6881})
+	if err == nil || !strings.Contains(err.Error(), "unregistered torrent") {
+		t.Errorf("got error %v, want the failure reason", err)
+	}
+}
+
+func TestAnnounceTiersStartsFirst(t *testing.T) {
+	var events, ports []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events = append(events, r.URL.Query().Get("event"))
+		ports = append(ports, r.URL.Query().Get("port"))
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	torrent := checkTorrent(make([]byte, 32), 16)
+	have := CreateBitfield(torrent.NumPieces())
+	for i := 0; i < torrent.NumPieces(); i++ {
+		have.SetPiece(i)
+	}
+	download := &Download{Torrent: torrent, Have: have, Port: 6889}
+
+	announceURL, _ := url.Parse(server.URL + "/announce")
+	trackers := &Trackers{Tiers: [][]*Tracker{{{AnnounceURL: announceURL}}}}
+
+	// The download completed before the tracker heard from us.
+	if _, err := trackers.announceTiers(torrent, download, EventCompleted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trackers.announceTiers(torrent, download, EventNone); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(events, ",") != "started,completed," {
+		t.Errorf("announced events %q, want started, completed and none", events)
+	}
+	for _, port := range ports {
+		if port != "6889" {
+			t.Errorf("announced port %s, want the download's 6889", port)
+		}
+	}
+}
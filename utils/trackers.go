@@ -1,47 +1,277 @@
 package utils
 
 import (
+	"errors"
+	"math/rand"
 	"net/url"
-	"sync"
+	"time"
 )
 
-type Trackers []Tracker
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	retryAnnounceInterval   = 15 * time.Second
+	stopAnnounceTimeout     = 5 * time.Second
+	scrapeInterval          = 5 * time.Minute
+)
+
+// Trackers holds the tiers of a torrent's announce-list as described in BEP 12.
+// Only one tracker is announced to at a time: tiers are tried in order, and the
+// trackers within a tier in order, with whichever tracker responds promoted to
+// the front of its tier.
+type Trackers struct {
+	Tiers [][]*Tracker
+
+	// quit interrupts the announce loop, and cancel the stopped announces
+	// once Stop gives up waiting on them.
+	quit   chan struct{}
+	cancel chan struct{}
+	done   chan struct{}
+}
+
+func NewTrackers(announceList [][]string) *Trackers {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	tiers := make([][]*Tracker, 0)
+	quit := make(chan struct{})
 
-func NewTrackers(announceList []string) Trackers {
-	trackers := make([]Tracker, 0)
+	for _, announceTier := range announceList {
+		tier := make([]*Tracker, 0)
+
+		for _, announceURLString := range announceTier {
+			announceUrl, err := url.Parse(announceURLString)
+			if err != nil {
+				continue
+			}
+
+			tracker := &Tracker{AnnounceURL: announceUrl, Cancel: quit}
+			tier = append(tier, tracker)
+		}
 
-	for _, announceURLString := range announceList {
-		announceUrl, err := url.Parse(announceURLString)
-		if err != nil {
+		if len(tier) == 0 {
 			continue
 		}
 
-		tracker := Tracker{AnnounceURL: announceUrl}
-		trackers = append(trackers, tracker)
+		random.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+		tiers = append(tiers, tier)
 	}
 
-	return trackers
+	return &Trackers{
+		Tiers:  tiers,
+		quit:   quit,
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start announces to the first responding tracker and keeps re-announcing at
+// the interval it asks for until Stop is called.
+func (trackers *Trackers) Start(torrent TorrentFile, download *Download) {
+	go func() {
+		defer close(trackers.done)
+		trackers.run(torrent, download)
+	}()
 }
 
-func (trackers Trackers) Announce(torrent TorrentFile, download *Download) {
-	peersMap := make(map[string]Peer)
-	peersMapLock := sync.Mutex{}
+// Stop sends the stopped event to every tracker we successfully started with,
+// waiting a short while for the announces to go out.
+func (trackers *Trackers) Stop() {
+	close(trackers.quit)
+
+	select {
+	case <-trackers.done:
+	case <-time.After(stopAnnounceTimeout):
+		close(trackers.cancel)
+	}
+}
+
+func (trackers *Trackers) run(torrent TorrentFile, download *Download) {
+	event := EventNone
+	failures := 0
+	nextAnnounce := time.Now()
+
+	completed := download.Completed
+	_, _, left := download.Counters()
+	if left == 0 {
+		completed = nil
+	}
 
-	for _, tracker := range trackers {
-		go func(tracker Tracker, torrent TorrentFile) {
-			peers, err := tracker.Announce(torrent)
+	scrapeTicker := time.NewTicker(scrapeInterval)
+	defer scrapeTicker.Stop()
+
+	for {
+		if !time.Now().Before(nextAnnounce) {
+			response, err := trackers.announceTiers(torrent, download, event)
+
+			wait := defaultAnnounceInterval
+			if err != nil {
+				Debugf("Error announcing to trackers: %s", err)
+
+				wait = retryAnnounceInterval << failures
+				if wait > defaultAnnounceInterval {
+					wait = defaultAnnounceInterval
+				} else {
+					failures += 1
+				}
+			} else {
+				event = EventNone
+				failures = 0
+
+				if response.Interval > 0 {
+					wait = response.Interval
+				}
+				if response.MinInterval > wait {
+					wait = response.MinInterval
+				}
+
+				download.SetPeerCounts(response.Seeders, response.Leechers)
+				download.AddPeers(response.Peers)
+			}
+
+			nextAnnounce = time.Now().Add(wait)
+		}
+
+		timer := time.NewTimer(time.Until(nextAnnounce))
+
+		select {
+		case <-timer.C:
+		case <-scrapeTicker.C:
+			timer.Stop()
+
+			result, err := trackers.Scrape(torrent.InfoHash)
+			if err != nil {
+				Debugf("Error scraping trackers: %s", err)
+				continue
+			}
+			download.SetSwarm(result)
+		case <-completed:
+			timer.Stop()
+			completed = nil
+			event = EventCompleted
+			nextAnnounce = time.Now()
+		case <-trackers.quit:
+			timer.Stop()
+
+			// The announces below still have to go out after quit.
+			for _, tier := range trackers.Tiers {
+				for _, tracker := range tier {
+					tracker.Cancel = trackers.cancel
+				}
+			}
+
+			// Shutting down straight after completing races the completed
+			// case above, so make sure the tracker still hears about it.
+			select {
+			case <-completed:
+				trackers.announceTiers(torrent, download, EventCompleted)
+			default:
+			}
+
+			trackers.stopAll(torrent, download)
+			return
+		}
+	}
+}
+
+// Scrape returns the swarm statistics from the first tracker, in tier order,
+// that answers a scrape for the info hash.
+func (trackers *Trackers) Scrape(infoHash [20]byte) (ScrapeResult, error) {
+	for _, tier := range trackers.Tiers {
+		for _, tracker := range tier {
+			results, err := tracker.Scrape([][20]byte{infoHash})
+			if err != nil {
+				Debugf("Error scraping tracker %s: %s", tracker.AnnounceURL, err)
+				continue
+			}
+
+			if result, ok := results[infoHash]; ok {
+				return result, nil
+			}
+		}
+	}
+
+	return ScrapeResult{}, errors.New("no tracker responded to scrape")
+}
+
+// announceTiers walks the tiers in order until a tracker responds. Trackers that
+// haven't been told about us yet are sent the started event first, followed by
+// any other event. A UDP tracker only
+// gets the full retransmission schedule if it's the last one left to try.
+func (trackers *Trackers) announceTiers(torrent TorrentFile, download *Download, event uint32) (*AnnounceResponse, error) {
+	remaining := 0
+	for _, tier := range trackers.Tiers {
+		remaining += len(tier)
+	}
+
+	for _, tier := range trackers.Tiers {
+		for i, tracker := range tier {
+			remaining -= 1
+			events := []uint32{event}
+			if !tracker.Started {
+				events = []uint32{EventStarted}
+				if event != EventNone {
+					events = append(events, event)
+				}
+			}
+
+			if remaining > 0 {
+				tracker.Budget = udpFallbackBudget
+			}
+
+			var response *AnnounceResponse
+			var err error
+			for _, trackerEvent := range events {
+				response, err = trackers.announce(tracker, torrent, download, trackerEvent)
+				if err != nil {
+					break
+				}
+				if trackerEvent == EventStarted {
+					tracker.Started = true
+				}
+			}
+
+			tracker.Budget = 0
 			if err != nil {
 				Debugf("Error connecting to tracker %s: %s", tracker.AnnounceURL, err)
-				return
+				continue
 			}
 
-			for _, peer := range peers {
-				peersMapLock.Lock()
-				peersMap[peer.IP.String()] = peer
-				peersMapLock.Unlock()
+			copy(tier[1:i+1], tier[0:i])
+			tier[0] = tracker
+
+			return response, nil
+		}
+	}
+
+	return nil, errors.New("no tracker responded")
+}
+
+func (trackers *Trackers) stopAll(torrent TorrentFile, download *Download) {
+	for _, tier := range trackers.Tiers {
+		for _, tracker := range tier {
+			if !tracker.Started {
+				continue
+			}
 
-				go download.AddPeer(peer)
+			_, err := trackers.announce(tracker, torrent, download, EventStopped)
+			if err != nil {
+				Debugf("Error stopping tracker %s: %s", tracker.AnnounceURL, err)
 			}
-		}(tracker, torrent)
+			tracker.Started = false
+		}
 	}
 }
+
+func (trackers *Trackers) announce(tracker *Tracker, torrent TorrentFile, download *Download, event uint32) (*AnnounceResponse, error) {
+	uploaded, downloaded, left := download.Counters()
+
+	announceMessage := GenerateAnnounceMessage(torrent, download.Port)
+	announceMessage.Event = event
+	announceMessage.Uploaded = uint64(uploaded)
+	announceMessage.Downloaded = uint64(downloaded)
+	announceMessage.Left = uint64(left)
+
+	Debugf("Announcing to tracker %s with event %d", tracker.AnnounceURL, event)
+
+	return tracker.Announce(announceMessage)
+}
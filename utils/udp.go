@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpConnectionIDLifetime = time.Minute
+
+	// BEP 15 allows up to 8 retransmissions, over an hour in all. Giving up
+	// after 2, under two minutes, keeps a dead tracker from holding up the
+	// rest of the tier.
+	udpMaxRetransmits = 2
+
+	// udpFallbackBudget is all the time a UDP tracker gets while other
+	// trackers are left to try.
+	udpFallbackBudget = 5 * time.Second
+	udpOptionURLData  = 0x2
+)
+
+var (
+	errUDPTimeout  = errors.New("UDP tracker did not respond")
+	errUDPCanceled = errors.New("UDP tracker request canceled")
+)
+
+// udpTimeout is the BEP 15 retransmission schedule: 15 * 2^n seconds.
+func udpTimeout(attempt int) time.Duration {
+	return 15 * time.Second << attempt
+}
+
+func (tracker *Tracker) AnnounceUDP(announceMessage AnnounceMessage) (*AnnounceResponse, error) {
+	conn, err := net.Dial("udp", tracker.AnnounceURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Skip the connection ID, action and transaction ID, which are filled in
+	// for every transmission.
+	payload := announceMessage.ToBytes()[16:]
+	payload = append(payload, tracker.urlDataOption()...)
+
+	resp, err := tracker.udpRequest(conn, udpActionAnnounce, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 12 {
+		return nil, errors.New("invalid UDP announce response")
+	}
+
+	// Trackers reached over IPv6 reply with 18-byte IPv6 peer entries.
+	peers := ParsePeers(resp[12:])
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		peers = ParsePeers6(resp[12:])
+	}
+
+	return &AnnounceResponse{
+		Peers:    peers,
+		Interval: time.Duration(binary.BigEndian.Uint32(resp[0:4])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(resp[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[8:12])),
+	}, nil
+}
+
+// urlDataOption encodes the path and query of the announce URL as the BEP 41
+// URLData option, split into chunks of at most 255 bytes.
+func (tracker *Tracker) urlDataOption() []byte {
+	requestString := tracker.AnnounceURL.EscapedPath()
+	if len(tracker.AnnounceURL.RawQuery) > 0 {
+		requestString += "?" + tracker.AnnounceURL.RawQuery
+	}
+
+	option := make([]byte, 0)
+	for len(requestString) > 0 {
+		chunk := requestString
+		if len(chunk) > 255 {
+			chunk = chunk[:255]
+		}
+
+		option = append(option, udpOptionURLData, byte(len(chunk)))
+		option = append(option, chunk...)
+		requestString = requestString[len(chunk):]
+	}
+
+	return option
+}
+
+// udpRequest sends a request, connecting first if we don't hold a connection ID
+// young enough to reuse, and retransmits on the BEP 15 schedule until the
+// tracker answers, Cancel is closed or Budget runs out. It returns the response with the action
+// and transaction ID stripped.
+func (tracker *Tracker) udpRequest(conn net.Conn, action uint32, payload []byte) ([]byte, error) {
+	// Closing the connection is the only way to interrupt a read in progress.
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-tracker.Cancel:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	var deadline time.Time
+	if tracker.Budget > 0 {
+		deadline = time.Now().Add(tracker.Budget)
+	}
+
+	for attempt := 0; attempt <= udpMaxRetransmits; attempt++ {
+		timeout := udpTimeout(attempt)
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			break
+		}
+
+		if time.Now().After(tracker.connectionIDExpiry) {
+			resp, err := udpExchange(conn, udpProtocolID, udpActionConnect, nil, limitTimeout(timeout, deadline))
+			if err == errUDPTimeout {
+				continue
+			}
+			if err != nil {
+				return nil, tracker.canceledError(err)
+			}
+			if len(resp) < 8 {
+				return nil, errors.New("invalid UDP connect response")
+			}
+
+			tracker.connectionID = binary.BigEndian.Uint64(resp[0:8])
+			tracker.connectionIDExpiry = time.Now().Add(udpConnectionIDLifetime)
+		}
+
+		resp, err := udpExchange(conn, tracker.connectionID, action, payload, limitTimeout(timeout, deadline))
+		if err == errUDPTimeout {
+			continue
+		}
+		if err != nil {
+			// The error may be an expired connection ID, so don't reuse it.
+			tracker.connectionIDExpiry = time.Time{}
+			return nil, tracker.canceledError(err)
+		}
+
+		return resp, nil
+	}
+
+	return nil, errUDPTimeout
+}
+
+// limitTimeout shortens timeout to end by deadline, if there is one.
+func limitTimeout(timeout time.Duration, deadline time.Time) time.Duration {
+	if !deadline.IsZero() && time.Until(deadline) < timeout {
+		return time.Until(deadline)
+	}
+	return timeout
+}
+
+// canceledError reports an error caused by Cancel closing the connection as
+// such.
+func (tracker *Tracker) canceledError(err error) error {
+	select {
+	case <-tracker.Cancel:
+		return errUDPCanceled
+	default:
+		return err
+	}
+}
+
+func udpExchange(conn net.Conn, connectionID uint64, action uint32, payload []byte, timeout time.Duration) ([]byte, error) {
+	transactionID := rand.Uint32()
+
+	packet := make([]byte, 16+len(payload))
+	binary.BigEndian.PutUint64(packet[0:8], connectionID)    // connection ID, or protocol ID when connecting
+	binary.BigEndian.PutUint32(packet[8:12], action)         // action
+	binary.BigEndian.PutUint32(packet[12:16], transactionID) // random transaction ID
+	copy(packet[16:], payload)
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	resp := make([]byte, 4096)
+
+	for {
+		numBytes, err := conn.Read(resp)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, errUDPTimeout
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Stale replies to earlier transmissions are dropped.
+		if numBytes < 8 || binary.BigEndian.Uint32(resp[4:8]) != transactionID {
+			continue
+		}
+
+		respAction := binary.BigEndian.Uint32(resp[0:4])
+		if respAction == udpActionError {
+			return nil, fmt.Errorf("tracker error: %s", resp[8:numBytes])
+		}
+		if respAction != action {
+			return nil, fmt.Errorf("unexpected UDP tracker action %d", respAction)
+		}
+
+		return resp[8:numBytes], nil
+	}
+}
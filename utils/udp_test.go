@@ -0,0 +1,242 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker serves the built-in tracker over loopback, passing every
+// request through handle first. It returns the announce URL and a count of
+// the connect requests received.
+func fakeUDPTracker(t *testing.T, handle func(packet []byte, resp []byte) []byte) (*url.URL, func() int) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	server := NewTrackerServer()
+	var lock sync.Mutex
+	connects := 0
+
+	go func() {
+		packet := make([]byte, 2048)
+		for {
+			numBytes, addr, err := conn.ReadFrom(packet)
+			if err != nil {
+				return
+			}
+
+			if numBytes >= 16 && binary.BigEndian.Uint32(packet[8:12]) == udpActionConnect {
+				lock.Lock()
+				connects += 1
+				lock.Unlock()
+			}
+
+			resp := handle(packet[:numBytes], server.handleUDP(packet[:numBytes], addr))
+			if resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	announceURL, _ := url.Parse("udp://" + conn.LocalAddr().String() + "/announce?passkey=secret")
+
+	return announceURL, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return connects
+	}
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	var lock sync.Mutex
+	var urlData []byte
+	announceURL, connects := fakeUDPTracker(t, func(packet []byte, resp []byte) []byte {
+		if binary.BigEndian.Uint32(packet[8:12]) == udpActionAnnounce {
+			lock.Lock()
+			urlData = append([]byte(nil), packet[98:]...)
+			lock.Unlock()
+		}
+
+		return resp
+	})
+
+	first := &Tracker{AnnounceURL: announceURL}
+	message := AnnounceMessage{InfoHash: [20]byte{1}, PeerID: [20]byte{1}, Left: 100, Port: 6881, NumWant: 50}
+	if _, err := first.Announce(message); err != nil {
+		t.Fatal(err)
+	}
+
+	second := &Tracker{AnnounceURL: announceURL}
+	message.PeerID = [20]byte{2}
+	message.Port = 6882
+	resp, err := second.Announce(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Peers) != 1 || !resp.Peers[0].IP.Equal(net.IPv4(127, 0, 0, 1)) || resp.Peers[0].Port != 6881 {
+		t.Errorf("got peers %v, want 127.0.0.1:6881", resp.Peers)
+	}
+	if resp.Leechers != 2 || resp.Interval != serverAnnounceInterval {
+		t.Errorf("got %d leechers and interval %s", resp.Leechers, resp.Interval)
+	}
+
+	// The connection ID is reused for the scrape.
+	results, err := second.Scrape([][20]byte{{1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[[20]byte{1}].Leechers != 2 || results[[20]byte{2}] != (ScrapeResult{}) {
+		t.Errorf("scraped %v", results)
+	}
+	if count := connects(); count != 2 {
+		t.Errorf("sent %d connect requests for two trackers, want 2", count)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	want := append([]byte{udpOptionURLData, 24}, "/announce?passkey=secret"...)
+	if !bytes.Equal(urlData, want) {
+		t.Errorf("sent URL data option %q, want %q", urlData, want)
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	announceURL, connects := fakeUDPTracker(t, func(packet []byte, resp []byte) []byte {
+		if binary.BigEndian.Uint32(packet[8:12]) != udpActionAnnounce {
+			return resp
+		}
+
+		resp = appendUint32(nil, udpActionError)
+		resp = append(resp, packet[12:16]...)
+		return append(resp, "torrent not registered"...)
+	})
+
+	tracker := &Tracker{AnnounceURL: announceURL}
+	for i := 0; i < 2; i++ {
+		_, err := tracker.Announce(AnnounceMessage{Port: 6881})
+		if err == nil || err.Error() != "tracker error: torrent not registered" {
+			t.Fatalf("got error %v, want the tracker's error message", err)
+		}
+	}
+
+	// An error may mean the connection ID expired, so it isn't reused.
+	if count := connects(); count != 2 {
+		t.Errorf("sent %d connect requests, want 2", count)
+	}
+}
+
+func TestUDPRequestCancel(t *testing.T) {
+	// A tracker that never answers.
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cancel := make(chan struct{})
+	tracker := &Tracker{Cancel: cancel}
+	time.AfterFunc(100*time.Millisecond, func() { close(cancel) })
+
+	start := time.Now()
+	_, err = tracker.udpRequest(conn, udpActionAnnounce, nil)
+	if err != errUDPCanceled {
+		t.Fatalf("got error %v, want %v", err, errUDPCanceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("request took %s to cancel", elapsed)
+	}
+}
+
+func TestUDPRequestBudget(t *testing.T) {
+	// A tracker that never answers.
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tracker := &Tracker{Budget: 100 * time.Millisecond}
+
+	start := time.Now()
+	_, err = tracker.udpRequest(conn, udpActionAnnounce, nil)
+	if err != errUDPTimeout {
+		t.Fatalf("got error %v, want %v", err, errUDPTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("request took %s with a budget of %s", elapsed, tracker.Budget)
+	}
+}
+
+func TestUDPExchangeIgnoresStaleReplies(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	go func() {
+		packet := make([]byte, 2048)
+		numBytes, addr, err := server.ReadFrom(packet)
+		if err != nil || numBytes < 16 {
+			return
+		}
+
+		transactionID := binary.BigEndian.Uint32(packet[12:16])
+		// The stale reply carries connection ID 1, ours 2.
+		for i, id := range []uint32{transactionID + 1, transactionID} {
+			resp := appendUint32(nil, udpActionConnect)
+			resp = appendUint32(resp, id)
+			server.WriteTo(appendUint64(resp, uint64(i+1)), addr)
+		}
+	}()
+
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resp, err := udpExchange(conn, udpProtocolID, udpActionConnect, nil, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if connectionID := binary.BigEndian.Uint64(resp); connectionID != 2 {
+		t.Errorf("got connection ID %d, want 2 from the reply to our transaction", connectionID)
+	}
+}
+
+func TestURLDataOption(t *testing.T) {
+	long := "/announce?" + string(bytes.Repeat([]byte("a"), 290))
+	announceURL, _ := url.Parse("udp://tracker.example:6969" + long)
+	tracker := &Tracker{AnnounceURL: announceURL}
+
+	option := tracker.urlDataOption()
+	if len(option) != 2+255+2+45 || option[1] != 255 || option[258] != 45 {
+		t.Fatalf("option of %d bytes split into %d and %d", len(option), option[1], option[258])
+	}
+	if string(option[2:257])+string(option[259:]) != long {
+		t.Error("option doesn't hold the whole path and query")
+	}
+}
@@ -0,0 +1,299 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// uTP (BEP 29) carries peer connections over UDP, backing off when it sees
+// queuing delay so it doesn't crowd out other traffic on the link.
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+
+	utpSelectiveAck = 1
+
+	utpVersion     = 1
+	utpHeaderSize  = 20
+	utpMaxPayload  = 1200
+	utpRecvWindow  = 1 << 20
+	utpMaxWindow   = 1 << 20
+	utpTargetDelay = 100 * time.Millisecond
+	utpMaxGain     = 3000 // bytes the window may grow by per round trip
+	utpMinTimeout  = 500 * time.Millisecond
+	utpMaxResends  = 6
+	utpTick        = 50 * time.Millisecond
+	utpCloseWait   = 30 * time.Second
+)
+
+var errUTPTimeout = errors.New("utp: connection timed out")
+
+type utpHeader struct {
+	Type          uint8
+	ConnectionID  uint16
+	Timestamp     uint32
+	TimestampDiff uint32
+	WindowSize    uint32
+	Seq           uint16
+	Ack           uint16
+
+	// SelectiveAck is a bitmask of packets received after Ack+1, starting with
+	// Ack+2 in the lowest bit of the first byte.
+	SelectiveAck []byte
+}
+
+func (header utpHeader) bytes(payload []byte) []byte {
+	packet := make([]byte, utpHeaderSize, utpHeaderSize+2+len(header.SelectiveAck)+len(payload))
+	packet[0] = header.Type<<4 | utpVersion
+	binary.BigEndian.PutUint16(packet[2:4], header.ConnectionID)
+	binary.BigEndian.PutUint32(packet[4:8], header.Timestamp)
+	binary.BigEndian.PutUint32(packet[8:12], header.TimestampDiff)
+	binary.BigEndian.PutUint32(packet[12:16], header.WindowSize)
+	binary.BigEndian.PutUint16(packet[16:18], header.Seq)
+	binary.BigEndian.PutUint16(packet[18:20], header.Ack)
+
+	if len(header.SelectiveAck) > 0 {
+		packet[1] = utpSelectiveAck
+		packet = append(packet, 0, byte(len(header.SelectiveAck)))
+		packet = append(packet, header.SelectiveAck...)
+	}
+
+	return append(packet, payload...)
+}
+
+// parseUTPPacket splits a datagram into its header and payload, skipping any
+// extensions. It fails for anything that isn't uTP.
+func parseUTPPacket(packet []byte) (utpHeader, []byte, error) {
+	if len(packet) < utpHeaderSize || packet[0]&0xf != utpVersion || packet[0]>>4 > utpSyn {
+		return utpHeader{}, nil, errors.New("not a uTP packet")
+	}
+
+	header := utpHeader{
+		Type:          packet[0] >> 4,
+		ConnectionID:  binary.BigEndian.Uint16(packet[2:4]),
+		Timestamp:     binary.BigEndian.Uint32(packet[4:8]),
+		TimestampDiff: binary.BigEndian.Uint32(packet[8:12]),
+		WindowSize:    binary.BigEndian.Uint32(packet[12:16]),
+		Seq:           binary.BigEndian.Uint16(packet[16:18]),
+		Ack:           binary.BigEndian.Uint16(packet[18:20]),
+	}
+
+	extension := packet[1]
+	offset := utpHeaderSize
+	for extension != 0 {
+		if offset+2 > len(packet) || offset+2+int(packet[offset+1]) > len(packet) {
+			return utpHeader{}, nil, errors.New("truncated uTP extension")
+		}
+
+		length := int(packet[offset+1])
+		if extension == utpSelectiveAck {
+			header.SelectiveAck = packet[offset+2 : offset+2+length]
+		}
+
+		extension = packet[offset]
+		offset += 2 + length
+	}
+
+	return header, packet[offset:], nil
+}
+
+func utpNow() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// seqLess compares sequence numbers that wrap around at 16 bits.
+func seqLess(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// UTPSocket is a UDP socket shared by every uTP connection on a port. It is
+// also a net.Listener for incoming connections.
+type UTPSocket struct {
+	conn     net.PacketConn
+	conns    map[string]*utpConn
+	accepted chan *utpConn
+	closed   chan struct{}
+	lock     sync.Mutex
+}
+
+func ListenUTP(port uint16) (*UTPSocket, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return nil, err
+	}
+
+	// A full window can arrive faster than the read loop drains it.
+	conn.SetReadBuffer(4 << 20)
+
+	socket := &UTPSocket{
+		conn:     conn,
+		conns:    make(map[string]*utpConn),
+		accepted: make(chan *utpConn, 16),
+		closed:   make(chan struct{}),
+	}
+
+	go socket.readLoop()
+	go socket.tickLoop()
+
+	return socket, nil
+}
+
+func utpKey(addr net.Addr, connectionID uint16) string {
+	return addr.String() + "/" + strconv.Itoa(int(connectionID))
+}
+
+func (socket *UTPSocket) readLoop() {
+	buffer := make([]byte, 65536)
+
+	for {
+		n, addr, err := socket.conn.ReadFrom(buffer)
+		if err != nil {
+			socket.Close()
+			return
+		}
+
+		packet := append([]byte(nil), buffer[:n]...)
+
+		header, payload, err := parseUTPPacket(packet)
+		if err != nil {
+			continue
+		}
+
+		socket.lock.Lock()
+		conn, ok := socket.conns[utpKey(addr, header.ConnectionID)]
+		if !ok && header.Type == utpSyn {
+			conn, ok = socket.conns[utpKey(addr, header.ConnectionID+1)]
+			if !ok {
+				conn = socket.newIncoming(addr, header)
+			}
+		}
+		socket.lock.Unlock()
+
+		if conn != nil {
+			conn.receive(header, payload)
+		}
+	}
+}
+
+// newIncoming sets up a connection for a SYN. The SYN itself is answered when
+// the connection receives it.
+func (socket *UTPSocket) newIncoming(addr net.Addr, syn utpHeader) *utpConn {
+	conn := newUTPConn(socket, addr, syn.ConnectionID+1, syn.ConnectionID)
+	conn.seq = uint16(rand.Intn(1 << 16))
+	conn.ack = syn.Seq
+	conn.connected = true
+
+	select {
+	case socket.accepted <- conn:
+		socket.conns[utpKey(addr, conn.recvID)] = conn
+		return conn
+	default:
+		Debugf("Dropping uTP connection from %s, too many waiting to be accepted", addr)
+		return nil
+	}
+}
+
+func (socket *UTPSocket) tickLoop() {
+	ticker := time.NewTicker(utpTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-socket.closed:
+			return
+		}
+
+		socket.lock.Lock()
+		conns := make(map[string]*utpConn, len(socket.conns))
+		for key, conn := range socket.conns {
+			conns[key] = conn
+		}
+		socket.lock.Unlock()
+
+		for key, conn := range conns {
+			if conn.tick(time.Now()) {
+				socket.lock.Lock()
+				delete(socket.conns, key)
+				socket.lock.Unlock()
+			}
+		}
+	}
+}
+
+func (socket *UTPSocket) send(packet []byte, addr net.Addr) {
+	socket.conn.WriteTo(packet, addr)
+}
+
+func (socket *UTPSocket) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	socket.lock.Lock()
+	recvID := uint16(rand.Intn(1 << 16))
+	for socket.conns[utpKey(addr, recvID)] != nil {
+		recvID++
+	}
+
+	conn := newUTPConn(socket, addr, recvID, recvID+1)
+	conn.seq = 1
+	socket.conns[utpKey(addr, recvID)] = conn
+	socket.lock.Unlock()
+
+	conn.lock.Lock()
+	conn.queue(utpSyn, nil)
+	conn.lock.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	err = conn.wait(&deadline, func() bool { return conn.connected || conn.err != nil })
+	if err == nil {
+		err = conn.err
+	}
+	if err != nil {
+		conn.abort(err)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (socket *UTPSocket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-socket.accepted:
+		return conn, nil
+	case <-socket.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (socket *UTPSocket) Addr() net.Addr {
+	return socket.conn.LocalAddr()
+}
+
+func (socket *UTPSocket) Close() error {
+	socket.lock.Lock()
+	defer socket.lock.Unlock()
+
+	select {
+	case <-socket.closed:
+		return nil
+	default:
+	}
+	close(socket.closed)
+
+	for _, conn := range socket.conns {
+		conn.abort(net.ErrClosed)
+	}
+
+	return socket.conn.Close()
+}
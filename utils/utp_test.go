@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenTestUTP(t *testing.T) *UTPSocket {
+	socket, err := ListenUTP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { socket.Close() })
+
+	return socket
+}
+
+func testUTPAddress(socket *UTPSocket) string {
+	_, port, _ := net.SplitHostPort(socket.Addr().String())
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func TestUTPTransfer(t *testing.T) {
+	server := listenTestUTP(t)
+	client := listenTestUTP(t)
+
+	// Large enough to take many packets and exercise the congestion window.
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		buffer := make([]byte, len(data))
+		io.ReadFull(conn, buffer)
+		received <- buffer
+
+		conn.Write([]byte("done"))
+	}()
+
+	conn, err := client.Dial(testUTPAddress(server), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case buffer := <-received:
+		if !bytes.Equal(buffer, data) {
+			t.Fatal("received data differs from what was sent")
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("transfer didn't finish")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "done" {
+		t.Fatalf("read reply %q, %v", reply, err)
+	}
+}
+
+func TestConnectUTP(t *testing.T) {
+	server := listenTestUTP(t)
+	port := server.Addr().(*net.UDPAddr).Port
+
+	go server.Accept()
+
+	peer := Peer{IP: net.IPv4(127, 0, 0, 1), Port: uint16(port), UTP: listenTestUTP(t)}
+	conn, err := peer.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(*utpConn); !ok {
+		t.Errorf("connected over %T, want uTP", conn)
+	}
+}
+
+func TestAddPeerDialsUTPOnlyForKnownPeers(t *testing.T) {
+	// A peer listening on both TCP and uTP.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	server, err := ListenUTP(uint16(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	accepted := make(chan net.Conn, 8)
+	for _, l := range []net.Listener{listener, server} {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+				conn.Close()
+			}
+		}(l)
+	}
+
+	download := &Download{Bans: NewBanList(), UTP: listenTestUTP(t), utpPeers: make(map[string]bool)}
+	peer := Peer{IP: net.IPv4(127, 0, 0, 1), Port: uint16(port)}
+
+	for _, known := range []bool{false, true} {
+		download.lock.Lock()
+		download.utpPeers[peer.Address()] = known
+		download.lock.Unlock()
+
+		// Handshakes fail once we hang up, after any retry in plaintext.
+		download.AddPeer(peer)
+
+		if len(accepted) == 0 {
+			t.Fatal("didn't connect to the peer")
+		}
+		for len(accepted) > 0 {
+			if _, overUTP := (<-accepted).(*utpConn); overUTP != known {
+				t.Errorf("dialed over uTP: %v, want %v", overUTP, known)
+			}
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// utpConn is one uTP connection, usable anywhere a TCP net.Conn is.
+type utpConn struct {
+	socket *UTPSocket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	lock      sync.Mutex
+	changed   chan struct{}
+	connected bool
+	closing   bool
+	closedAt  time.Time
+	err       error
+
+	// Sending. outgoing holds packets that haven't been acknowledged yet.
+	seq        uint16
+	outgoing   []*utpPacket
+	inFlight   int
+	window     float64
+	peerWindow uint32
+	rtt        time.Duration
+	rttVar     time.Duration
+	timeout    time.Duration
+	duplicates int
+
+	// LEDBAT keeps the lowest one-way delay seen in each of the last two
+	// minutes as the baseline that queuing delay is measured against.
+	delayHistory [2]uint32
+	delayMinute  int64
+
+	// Receiving. ack is the last sequence number received in order.
+	ack        uint16
+	readBuffer bytes.Buffer
+	outOfOrder map[uint16]utpReceived
+	eof        bool
+	replyDiff  uint32
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+type utpPacket struct {
+	header  utpHeader
+	payload []byte
+	sentAt  time.Time
+	resends int
+	acked   bool
+}
+
+type utpReceived struct {
+	fin     bool
+	payload []byte
+}
+
+func newUTPConn(socket *UTPSocket, remote net.Addr, recvID uint16, sendID uint16) *utpConn {
+	return &utpConn{
+		socket:     socket,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		changed:    make(chan struct{}),
+		window:     utpMaxPayload * 2,
+		peerWindow: utpRecvWindow,
+		timeout:    time.Second,
+		outOfOrder: make(map[uint16]utpReceived),
+	}
+}
+
+// notify wakes everything waiting on the connection. Callers hold the lock.
+func (conn *utpConn) notify() {
+	close(conn.changed)
+	conn.changed = make(chan struct{})
+}
+
+// wait blocks until ready returns true or the deadline passes, checking both
+// with the lock held each time the connection changes.
+func (conn *utpConn) wait(deadline *time.Time, ready func() bool) error {
+	for {
+		conn.lock.Lock()
+		if ready() {
+			conn.lock.Unlock()
+			return nil
+		}
+		changed := conn.changed
+		until := *deadline
+		conn.lock.Unlock()
+
+		if until.IsZero() {
+			<-changed
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(until))
+		select {
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+			return os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (conn *utpConn) header(packetType uint8, seq uint16) utpHeader {
+	window := utpRecvWindow - conn.readBuffer.Len()
+	if window < 0 {
+		window = 0
+	}
+
+	connectionID := conn.sendID
+	if packetType == utpSyn {
+		connectionID = conn.recvID
+	}
+
+	return utpHeader{
+		Type:          packetType,
+		ConnectionID:  connectionID,
+		Timestamp:     utpNow(),
+		TimestampDiff: conn.replyDiff,
+		WindowSize:    uint32(window),
+		Seq:           seq,
+		Ack:           conn.ack,
+		SelectiveAck:  conn.selectiveAck(),
+	}
+}
+
+// selectiveAck lists the packets received out of order, so the sender only
+// resends what is missing.
+func (conn *utpConn) selectiveAck() []byte {
+	if len(conn.outOfOrder) == 0 {
+		return nil
+	}
+
+	bits := 0
+	for seq := range conn.outOfOrder {
+		if offset := int(seq - conn.ack - 2); offset >= bits {
+			bits = offset + 1
+		}
+	}
+
+	// The mask is a multiple of 32 bits.
+	mask := make([]byte, (bits+31)/32*4)
+	for seq := range conn.outOfOrder {
+		offset := int(seq - conn.ack - 2)
+		mask[offset/8] |= 1 << (offset % 8)
+	}
+
+	return mask
+}
+
+// queue sends a packet that takes a sequence number and so has to be
+// acknowledged, keeping it for retransmission.
+func (conn *utpConn) queue(packetType uint8, payload []byte) {
+	packet := &utpPacket{header: conn.header(packetType, conn.seq), payload: payload, sentAt: time.Now()}
+	conn.seq++
+
+	conn.outgoing = append(conn.outgoing, packet)
+	conn.inFlight += len(payload)
+	conn.socket.send(packet.header.bytes(payload), conn.remote)
+}
+
+func (conn *utpConn) resend(packet *utpPacket) {
+	packet.header = conn.header(packet.header.Type, packet.header.Seq)
+	packet.sentAt = time.Now()
+	packet.resends++
+	conn.socket.send(packet.header.bytes(packet.payload), conn.remote)
+}
+
+func (conn *utpConn) sendState() {
+	// State packets don't take a sequence number of their own.
+	conn.socket.send(conn.header(utpState, conn.seq).bytes(nil), conn.remote)
+}
+
+func (conn *utpConn) receive(header utpHeader, payload []byte) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	defer conn.notify()
+
+	conn.replyDiff = utpNow() - header.Timestamp
+
+	switch header.Type {
+	case utpReset:
+		conn.err = io.ErrUnexpectedEOF
+		return
+	case utpSyn:
+		conn.sendState()
+		return
+	case utpState:
+		if !conn.connected {
+			// The SYN's acknowledgement carries the sequence number the other
+			// side's data will start at.
+			conn.connected = true
+			conn.ack = header.Seq - 1
+		}
+	}
+
+	if !conn.connected {
+		return
+	}
+
+	conn.peerWindow = header.WindowSize
+	conn.processAck(header)
+
+	if header.Type != utpData && header.Type != utpFin {
+		return
+	}
+
+	if !seqLess(conn.ack, header.Seq) || int(header.Seq-conn.ack) > utpRecvWindow/utpMaxPayload {
+		// Already received, or too far ahead to buffer. Acknowledge it again in
+		// case our acknowledgement was lost.
+		conn.sendState()
+		return
+	}
+
+	conn.outOfOrder[header.Seq] = utpReceived{fin: header.Type == utpFin, payload: payload}
+	for {
+		next, ok := conn.outOfOrder[conn.ack+1]
+		if !ok {
+			break
+		}
+
+		delete(conn.outOfOrder, conn.ack+1)
+		conn.ack++
+		conn.readBuffer.Write(next.payload)
+
+		if next.fin {
+			conn.eof = true
+			break
+		}
+	}
+
+	conn.sendState()
+}
+
+// processAck drops acknowledged packets, measures round trip time and delay,
+// and adjusts the congestion window.
+func (conn *utpConn) processAck(header utpHeader) {
+	if len(conn.outgoing) == 0 || !seqLess(header.Ack, conn.seq) {
+		return
+	}
+
+	acked, ackedPackets := 0, 0
+	ack := func(packet *utpPacket) {
+		if packet.acked {
+			return
+		}
+
+		packet.acked = true
+		ackedPackets++
+		acked += len(packet.payload)
+		conn.inFlight -= len(packet.payload)
+
+		if packet.resends == 0 {
+			conn.updateRTT(time.Since(packet.sentAt))
+		}
+	}
+
+	for len(conn.outgoing) > 0 && !seqLess(header.Ack, conn.outgoing[0].header.Seq) {
+		ack(conn.outgoing[0])
+		conn.outgoing = conn.outgoing[1:]
+	}
+
+	for _, packet := range conn.outgoing {
+		offset := int(packet.header.Seq - header.Ack - 2)
+		if offset < len(header.SelectiveAck)*8 && header.SelectiveAck[offset/8]&(1<<(offset%8)) != 0 {
+			ack(packet)
+		}
+	}
+
+	if len(header.SelectiveAck) > 0 {
+		conn.resendSkipped()
+	}
+
+	if ackedPackets == 0 {
+		// Three acknowledgements of the same packet mean the one after it was
+		// lost, so resend it without waiting for the timeout.
+		if header.Type == utpState {
+			conn.duplicates++
+			if conn.duplicates == 3 && len(conn.outgoing) > 0 {
+				conn.resend(conn.outgoing[0])
+				conn.window = maxFloat(conn.window/2, utpMaxPayload)
+			}
+		}
+		return
+	}
+
+	conn.duplicates = 0
+	if acked > 0 {
+		conn.updateWindow(header.TimestampDiff, acked)
+	}
+}
+
+// resendSkipped resends packets that at least three later packets have been
+// selectively acknowledged past, treating them as lost.
+func (conn *utpConn) resendSkipped() {
+	later, resent := 0, 0
+
+	for i := len(conn.outgoing) - 1; i >= 0 && resent < 4; i-- {
+		packet := conn.outgoing[i]
+		if packet.acked {
+			later++
+			continue
+		}
+
+		if later >= 3 && time.Since(packet.sentAt) > conn.rtt {
+			conn.resend(packet)
+			resent++
+		}
+	}
+
+	if resent > 0 {
+		conn.window = maxFloat(conn.window/2, utpMaxPayload)
+	}
+}
+
+func (conn *utpConn) updateRTT(sample time.Duration) {
+	if conn.rtt == 0 {
+		conn.rtt = sample
+		conn.rttVar = sample / 2
+	} else {
+		delta := conn.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		conn.rttVar += (delta - conn.rttVar) / 4
+		conn.rtt += (sample - conn.rtt) / 8
+	}
+
+	conn.timeout = conn.rtt + 4*conn.rttVar
+	if conn.timeout < utpMinTimeout {
+		conn.timeout = utpMinTimeout
+	}
+}
+
+// updateWindow is LEDBAT: grow the window while the delay our packets see is
+// under target, and shrink it as queues build up.
+func (conn *utpConn) updateWindow(delay uint32, acked int) {
+	if delay == 0 {
+		return
+	}
+
+	minute := time.Now().Unix() / 60
+	if minute != conn.delayMinute {
+		conn.delayHistory[0], conn.delayHistory[1] = conn.delayHistory[1], delay
+		conn.delayMinute = minute
+	}
+	if delay < conn.delayHistory[1] {
+		conn.delayHistory[1] = delay
+	}
+
+	base := conn.delayHistory[1]
+	if conn.delayHistory[0] != 0 && conn.delayHistory[0] < base {
+		base = conn.delayHistory[0]
+	}
+
+	queuing := time.Duration(delay-base) * time.Microsecond
+	offTarget := float64(utpTargetDelay-queuing) / float64(utpTargetDelay)
+	windowFactor := float64(acked) / maxFloat(conn.window, float64(acked))
+
+	conn.window += utpMaxGain * offTarget * windowFactor
+	conn.window = maxFloat(conn.window, utpMaxPayload)
+	if conn.window > utpMaxWindow {
+		conn.window = utpMaxWindow
+	}
+}
+
+func maxFloat(a float64, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// tick retransmits timed out packets and reports whether the connection is
+// finished and can be forgotten.
+func (conn *utpConn) tick(now time.Time) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.closing && (len(conn.outgoing) == 0 || conn.err != nil || now.Sub(conn.closedAt) > utpCloseWait) {
+		return true
+	}
+
+	if len(conn.outgoing) == 0 || now.Sub(conn.outgoing[0].sentAt) < conn.timeout {
+		return false
+	}
+
+	packet := conn.outgoing[0]
+	if packet.resends >= utpMaxResends {
+		conn.err = errUTPTimeout
+		conn.outgoing = nil
+		conn.notify()
+		return conn.closing
+	}
+
+	conn.window = utpMaxPayload
+	conn.timeout *= 2
+	conn.resend(packet)
+
+	return false
+}
+
+// abort ends the connection at once, with err returned from future calls.
+func (conn *utpConn) abort(err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.err == nil {
+		conn.err = err
+	}
+	if !conn.closing {
+		conn.closing = true
+		conn.closedAt = time.Now()
+	}
+	conn.notify()
+}
+
+func (conn *utpConn) Read(data []byte) (int, error) {
+	err := conn.wait(&conn.readDeadline, func() bool {
+		return conn.readBuffer.Len() > 0 || conn.eof || conn.err != nil || conn.closing
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.readBuffer.Len() > 0 {
+		full := conn.readBuffer.Len() > utpRecvWindow-utpMaxPayload
+		n, _ := conn.readBuffer.Read(data)
+
+		// Let the sender know the window has opened up again.
+		if full {
+			conn.sendState()
+		}
+		return n, nil
+	}
+
+	if conn.closing {
+		return 0, net.ErrClosed
+	}
+	if conn.err != nil {
+		return 0, conn.err
+	}
+
+	return 0, io.EOF
+}
+
+func (conn *utpConn) Write(data []byte) (int, error) {
+	written := 0
+
+	for written < len(data) {
+		chunk := data[written:]
+		if len(chunk) > utpMaxPayload {
+			chunk = chunk[:utpMaxPayload]
+		}
+
+		// Always allow one packet in flight so a closed window gets probed.
+		err := conn.wait(&conn.writeDeadline, func() bool {
+			window := conn.window
+			if float64(conn.peerWindow) < window {
+				window = float64(conn.peerWindow)
+			}
+
+			return conn.inFlight == 0 || float64(conn.inFlight+len(chunk)) <= window || conn.err != nil || conn.closing
+		})
+		if err != nil {
+			return written, err
+		}
+
+		conn.lock.Lock()
+		if conn.closing {
+			conn.lock.Unlock()
+			return written, net.ErrClosed
+		}
+		if conn.err != nil {
+			conn.lock.Unlock()
+			return written, conn.err
+		}
+
+		conn.queue(utpData, append([]byte(nil), chunk...))
+		conn.lock.Unlock()
+
+		written += len(chunk)
+	}
+
+	return written, nil
+}
+
+// Close sends a FIN and returns at once. The socket keeps retransmitting until
+// everything has been acknowledged.
+func (conn *utpConn) Close() error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.closing {
+		return nil
+	}
+
+	conn.closing = true
+	conn.closedAt = time.Now()
+	if conn.connected && conn.err == nil {
+		conn.queue(utpFin, nil)
+	}
+	conn.notify()
+
+	return nil
+}
+
+func (conn *utpConn) LocalAddr() net.Addr {
+	return conn.socket.Addr()
+}
+
+func (conn *utpConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *utpConn) SetDeadline(deadline time.Time) error {
+	conn.SetReadDeadline(deadline)
+	return conn.SetWriteDeadline(deadline)
+}
+
+func (conn *utpConn) SetReadDeadline(deadline time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.readDeadline = deadline
+	conn.notify()
+	return nil
+}
+
+func (conn *utpConn) SetWriteDeadline(deadline time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.writeDeadline = deadline
+	conn.notify()
+	return nil
+}
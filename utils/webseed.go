@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Web seeds that fail a request are retried after webSeedRetry, doubling for
+// each failure in a row, and given up on after maxWebSeedErrors. Busy seeds
+// asking us to wait longer than webSeedMaxWait times webSeedRetry are retried
+// sooner.
+const (
+	maxWebSeedErrors = 5
+	webSeedMaxWait   = 8
+)
+
+var webSeedRetry = 5 * time.Second
+
+// WebSeed downloads pieces over HTTP, either from a plain file server using
+// Range requests (BEP 19, "url-list") or from a seeding script that serves
+// whole pieces (BEP 17, "httpseeds").
+type WebSeed struct {
+	URL        *url.URL
+	PieceBased bool
+	client     *http.Client
+
+	// unavailableUntil is set after a failed request. Until then the seed has
+	// no pieces, so they go to other sources.
+	unavailableUntil time.Time
+}
+
+func NewWebSeeds(torrent TorrentFile) []*WebSeed {
+	seeds := make([]*WebSeed, 0)
+
+	add := func(rawURL string, pieceBased bool) {
+		seedURL, err := url.Parse(rawURL)
+		if err != nil || (seedURL.Scheme != "http" && seedURL.Scheme != "https") {
+			Debugf("Ignoring invalid web seed %s", rawURL)
+			return
+		}
+
+		seeds = append(seeds, &WebSeed{
+			URL:        seedURL,
+			PieceBased: pieceBased,
+			client:     &http.Client{Timeout: 30 * time.Second},
+		})
+	}
+
+	for _, rawURL := range torrent.URLList {
+		add(rawURL, false)
+	}
+	for _, rawURL := range torrent.HTTPSeeds {
+		add(rawURL, true)
+	}
+
+	return seeds
+}
+
+func (download *Download) AddWebSeed(seed *WebSeed) {
+	download.fetchPieces(seed)
+}
+
+func (seed *WebSeed) HasPiece(index int) bool {
+	return !time.Now().Before(seed.unavailableUntil)
+}
+
+// backOff makes the seed unavailable for at least delay.
+func (seed *WebSeed) backOff(delay time.Duration) {
+	if until := time.Now().Add(delay); until.After(seed.unavailableUntil) {
+		seed.unavailableUntil = until
+	}
+}
+
+func (seed *WebSeed) String() string {
+	return fmt.Sprintf("web seed %s", seed.URL)
+}
+
+func (seed *WebSeed) GetPiece(index int, torrent TorrentFile) ([]byte, error) {
+	pieceSize := torrent.PieceLength
+	remainingBytes := torrent.Length - (index * torrent.PieceLength)
+	if remainingBytes < pieceSize {
+		pieceSize = remainingBytes
+	}
+
+	if seed.PieceBased {
+		return seed.getWholePiece(index, pieceSize, torrent)
+	}
+
+	piece := make([]byte, pieceSize)
+	for _, fileRange := range torrent.FileRanges(index*torrent.PieceLength, pieceSize) {
+		if fileRange.Padding {
+			continue
+		}
+
+		data := piece[fileRange.PieceOffset : fileRange.PieceOffset+fileRange.Length]
+
+		err := seed.getRange(seed.fileURL(fileRange.Path, len(torrent.Files) > 0), fileRange.FileOffset, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return piece, nil
+}
+
+// fileURL follows BEP 19: a URL ending in a slash is a directory that the
+// torrent name (and, for multi-file torrents, file path) is appended to.
+func (seed *WebSeed) fileURL(path []string, multiFile bool) string {
+	base := seed.URL.String()
+	if !multiFile && !strings.HasSuffix(base, "/") {
+		return base
+	}
+
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	escaped := make([]string, 0, len(path))
+	for _, segment := range path {
+		escaped = append(escaped, url.PathEscape(segment))
+	}
+
+	return base + strings.Join(escaped, "/")
+}
+
+func (seed *WebSeed) getRange(fileURL string, offset int, data []byte) error {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+len(data)-1))
+
+	httpResp, err := seed.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	switch httpResp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range, so skip to the part we asked for.
+		if _, err := io.CopyN(io.Discard, httpResp.Body, int64(offset)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unexpected status %s from %s", httpResp.Status, fileURL)
+	}
+
+	_, err = io.ReadFull(httpResp.Body, data)
+	return err
+}
+
+func (seed *WebSeed) getWholePiece(index int, pieceSize int, torrent TorrentFile) ([]byte, error) {
+	pieceURL := *seed.URL
+	q := pieceURL.Query()
+	q.Set("info_hash", string(torrent.InfoHash[:]))
+	q.Set("piece", strconv.Itoa(index))
+	pieceURL.RawQuery = q.Encode()
+
+	httpResp, err := seed.client.Get(pieceURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	// A busy seed replies 503 with the number of seconds to wait as the body.
+	if httpResp.StatusCode == http.StatusServiceUnavailable {
+		body, _ := io.ReadAll(io.LimitReader(httpResp.Body, 16))
+		if seconds, err := strconv.Atoi(strings.TrimSpace(string(body))); err == nil {
+			delay := time.Duration(seconds) * time.Second
+			if delay > webSeedMaxWait*webSeedRetry {
+				delay = webSeedMaxWait * webSeedRetry
+			}
+			seed.backOff(delay)
+		}
+
+		return nil, errors.New("web seed is busy")
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", httpResp.Status, seed.URL)
+	}
+
+	piece := make([]byte, pieceSize)
+	_, err = io.ReadFull(httpResp.Body, piece)
+	if err != nil {
+		return nil, err
+	}
+
+	return piece, nil
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebSeedGetPiece(t *testing.T) {
+	data := []byte("the contents of a file served by a plain web server")
+	torrent := checkTorrent(data, 16)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("piece") {
+			index, _ := strconv.Atoi(r.URL.Query().Get("piece"))
+			w.Write(data[index*16 : index*16+torrent.PieceSize(index)])
+			return
+		}
+
+		http.ServeContent(w, r, "check", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	seedURL, _ := url.Parse(server.URL + "/check")
+
+	for _, pieceBased := range []bool{false, true} {
+		seed := &WebSeed{URL: seedURL, PieceBased: pieceBased, client: server.Client()}
+
+		for i := 0; i < torrent.NumPieces(); i++ {
+			piece, err := seed.GetPiece(i, torrent)
+			if err != nil {
+				t.Fatalf("piece %d: %s", i, err)
+			}
+
+			if want := data[i*16 : i*16+torrent.PieceSize(i)]; !bytes.Equal(piece, want) {
+				t.Errorf("piece %d is %q, want %q", i, piece, want)
+			}
+		}
+	}
+}
+
+func TestWebSeedGivesUp(t *testing.T) {
+	defer func(retry time.Duration) { webSeedRetry = retry }(webSeedRetry)
+	webSeedRetry = time.Millisecond
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	torrent := checkTorrent(make([]byte, 64), 16)
+	download, err := StartDownload(torrent, NewMemoryStorage(torrent), DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer download.Close()
+
+	seedURL, _ := url.Parse(server.URL)
+	done := make(chan struct{})
+	go func() {
+		download.AddWebSeed(&WebSeed{URL: seedURL, client: server.Client()})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("kept requesting from a failing web seed")
+	}
+
+	if got := atomic.LoadInt32(&requests); got != maxWebSeedErrors {
+		t.Errorf("made %d requests, want %d", got, maxWebSeedErrors)
+	}
+}
+
+func TestWebSeedBusy(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("3600"))
+	}))
+	defer server.Close()
+
+	torrent := checkTorrent(make([]byte, 64), 16)
+	seedURL, _ := url.Parse(server.URL)
+	seed := &WebSeed{URL: seedURL, PieceBased: true, client: server.Client()}
+
+	start := time.Now()
+	if _, err := seed.GetPiece(0, torrent); err == nil {
+		t.Fatal("got a piece from a busy web seed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s, waiting out the busy seed", elapsed)
+	}
+
+	// The wait asked for is capped, and the seed offers nothing meanwhile.
+	if seed.HasPiece(0) {
+		t.Error("busy web seed has pieces")
+	}
+	if wait := time.Until(seed.unavailableUntil); wait > webSeedMaxWait*webSeedRetry {
+		t.Errorf("waiting %s for a busy web seed, want at most %s", wait, webSeedMaxWait*webSeedRetry)
+	}
+
+	// Closing the download stops the wait.
+	download, err := StartDownload(torrent, NewMemoryStorage(torrent), DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed.unavailableUntil = time.Time{}
+	done := make(chan struct{})
+	go func() {
+		download.AddWebSeed(seed)
+		close(done)
+	}()
+
+	<-requests
+	<-requests
+	download.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("kept waiting on a busy web seed after the download closed")
+	}
+}